@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of seconds between the Windows FILETIME epoch, 1601-01-01, and the Unix epoch
+const fileTimeEpochOffset = 11644473600
+
+// Timestamps which have never been set, or which never expire, are returned as this rather than as a date
+const neverTimestamp = "never"
+
+// fileTimeAttributes are stored as Windows FILETIME values; the number of 100 nanosecond intervals since 1601-01-01 UTC
+var fileTimeAttributes = map[string]bool{
+	"pwdlastset":                          true,
+	"lastlogon":                           true,
+	"lastlogoff":                          true,
+	"lastlogontimestamp":                  true,
+	"accountexpires":                      true,
+	"badpasswordtime":                     true,
+	"lockouttime":                         true,
+	"lastsettime":                         true,
+	"priorsettime":                        true,
+	"creationtime":                        true,
+	"msds-userpasswordexpirytimecomputed": true,
+	"msds-lastsuccessfulinteractivelogontime": true,
+	"msds-lastfailedinteractivelogontime":     true,
+	"ms-mcs-admpwdexpirationtime":             true,
+	"mslaps-passwordexpirationtime":           true,
+}
+
+// generalizedTimeAttributes are stored using the LDAP GeneralizedTime syntax, e.g. 20211104093000.0Z
+var generalizedTimeAttributes = map[string]bool{
+	"whencreated":              true,
+	"whenchanged":              true,
+	"createtimestamp":          true,
+	"modifytimestamp":          true,
+	"dscorepropagationdata":    true,
+	"msexchwhenmailboxcreated": true,
+	"pwdchangedtime":           true,
+	"pwdaccountlockedtime":     true,
+}
+
+type bitFlag struct {
+	value uint32
+	name  string
+}
+
+// flagAttributes are bitmasks, which are expanded into the names of the flags that are set.
+// The flags are listed in bit order so that the names are always returned in the same order.
+var flagAttributes = map[string][]bitFlag{
+	"useraccountcontrol":                 userAccountControlFlags,
+	"msds-user-account-control-computed": userAccountControlFlags,
+	"grouptype":                          groupTypeFlags,
+}
+
+var userAccountControlFlags = []bitFlag{
+	{0x00000001, "SCRIPT"},
+	{0x00000002, "ACCOUNTDISABLE"},
+	{0x00000008, "HOMEDIR_REQUIRED"},
+	{0x00000010, "LOCKOUT"},
+	{0x00000020, "PASSWD_NOTREQD"},
+	{0x00000040, "PASSWD_CANT_CHANGE"},
+	{0x00000080, "ENCRYPTED_TEXT_PWD_ALLOWED"},
+	{0x00000100, "TEMP_DUPLICATE_ACCOUNT"},
+	{0x00000200, "NORMAL_ACCOUNT"},
+	{0x00000800, "INTERDOMAIN_TRUST_ACCOUNT"},
+	{0x00001000, "WORKSTATION_TRUST_ACCOUNT"},
+	{0x00002000, "SERVER_TRUST_ACCOUNT"},
+	{0x00010000, "DONT_EXPIRE_PASSWORD"},
+	{0x00020000, "MNS_LOGON_ACCOUNT"},
+	{0x00040000, "SMARTCARD_REQUIRED"},
+	{0x00080000, "TRUSTED_FOR_DELEGATION"},
+	{0x00100000, "NOT_DELEGATED"},
+	{0x00200000, "USE_DES_KEY_ONLY"},
+	{0x00400000, "DONT_REQ_PREAUTH"},
+	{0x00800000, "PASSWORD_EXPIRED"},
+	{0x01000000, "TRUSTED_TO_AUTH_FOR_DELEGATION"},
+	{0x04000000, "PARTIAL_SECRETS_ACCOUNT"},
+}
+
+var groupTypeFlags = []bitFlag{
+	{0x00000001, "BUILTIN_LOCAL_GROUP"},
+	{0x00000002, "ACCOUNT_GROUP"},
+	{0x00000004, "RESOURCE_GROUP"},
+	{0x00000008, "UNIVERSAL_GROUP"},
+	{0x00000010, "APP_BASIC_GROUP"},
+	{0x00000020, "APP_QUERY_GROUP"},
+	{0x80000000, "SECURITY_ENABLED"},
+}
+
+// sAMAccountTypes maps the values of sAMAccountType, which is an enumeration rather than a bitmask, to their names
+var sAMAccountTypes = map[uint32]string{
+	0x00000000: "SAM_DOMAIN_OBJECT",
+	0x10000000: "SAM_GROUP_OBJECT",
+	0x10000001: "SAM_NON_SECURITY_GROUP_OBJECT",
+	0x20000000: "SAM_ALIAS_OBJECT",
+	0x20000001: "SAM_NON_SECURITY_ALIAS_OBJECT",
+	0x30000000: "SAM_USER_OBJECT",
+	0x30000001: "SAM_MACHINE_ACCOUNT",
+	0x30000002: "SAM_TRUST_ACCOUNT",
+	0x40000000: "SAM_APP_BASIC_GROUP",
+	0x40000001: "SAM_APP_QUERY_GROUP",
+	0x7fffffff: "SAM_ACCOUNT_TYPE_MAX",
+}
+
+// decodeValues converts the values of AD timestamp and enumeration attributes into something readable.
+// Timestamps are returned in RFC 3339 format, and sAMAccountType as the name of the account type.
+// Values which cannot be decoded, and values of any other attributes, are returned unchanged.
+func decodeValues(attribute string, values []string) []string {
+	name, _ := splitAttributeOptions(attribute)
+	name = strings.ToLower(name)
+
+	var decode func(string) (string, bool)
+
+	switch {
+	case fileTimeAttributes[name]:
+		decode = decodeFileTime
+	case generalizedTimeAttributes[name]:
+		decode = decodeGeneralizedTime
+	case name == "samaccounttype":
+		decode = decodeSAMAccountType
+	default:
+		return values
+	}
+
+	decoded := make([]string, len(values))
+	for i, v := range values {
+		d, ok := decode(v)
+		if !ok {
+			d = v
+		}
+
+		decoded[i] = d
+	}
+
+	return decoded
+}
+
+// decodeFlags expands a bitmask attribute into the names of the flags which are set.
+// Any bits set which don't have a name are returned as a hex value so that nothing is lost.
+// It returns false if the attribute is not a bitmask, or the value cannot be parsed.
+func decodeFlags(attribute string, value string) ([]string, bool) {
+	name, _ := splitAttributeOptions(attribute)
+
+	flags, ok := flagAttributes[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+
+	mask, ok := parseUint32(value)
+	if !ok {
+		return nil, false
+	}
+
+	names := []string{}
+	for _, f := range flags {
+		if mask&f.value != 0 {
+			names = append(names, f.name)
+			mask &^= f.value
+		}
+	}
+
+	if mask != 0 {
+		names = append(names, fmt.Sprintf("0x%08X", mask))
+	}
+
+	return names, true
+}
+
+// parseUint32 parses the string form of an AD integer attribute.
+// Some, such as groupType, are signed 32-bit values in the directory, so negative values are converted to their unsigned equivalent.
+func parseUint32(value string) (uint32, bool) {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || v < math.MinInt32 || v > math.MaxUint32 {
+		return 0, false
+	}
+
+	return uint32(v), true
+}
+
+func decodeFileTime(value string) (string, bool) {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || v < 0 {
+		return "", false
+	}
+
+	if v == 0 || v == math.MaxInt64 {
+		return neverTimestamp, true
+	}
+
+	t := time.Unix(v/1e7-fileTimeEpochOffset, (v%1e7)*100).UTC()
+
+	return t.Format(time.RFC3339), true
+}
+
+func decodeGeneralizedTime(value string) (string, bool) {
+	// Fractional seconds are accepted after the seconds when parsing, even though they are not in the layout
+	layouts := []string{
+		"20060102150405Z0700",
+		"200601021504Z0700",
+		"2006010215Z0700",
+	}
+
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC().Format(time.RFC3339), true
+		}
+	}
+
+	return "", false
+}
+
+func decodeSAMAccountType(value string) (string, bool) {
+	v, ok := parseUint32(value)
+	if !ok {
+		return "", false
+	}
+
+	name, ok := sAMAccountTypes[v]
+
+	return name, ok
+}
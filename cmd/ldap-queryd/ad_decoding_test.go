@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFileTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"132809868000000000", "2021-11-10T03:00:00Z", true},
+		{"116444736000000000", "1970-01-01T00:00:00Z", true},
+		{"116444736009999999", "1970-01-01T00:00:00Z", true},
+		{"1", "1601-01-01T00:00:00Z", true},
+		{"0", neverTimestamp, true},
+		{"9223372036854775807", neverTimestamp, true},
+		{"-1", "", false},
+		{"9223372036854775808", "", false},
+		{"", "", false},
+		{"20211104093000.0Z", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := decodeFileTime(tt.value)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestDecodeGeneralizedTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"20211104093000.0Z", "2021-11-04T09:30:00Z", true},
+		{"20211104093000Z", "2021-11-04T09:30:00Z", true},
+		{"20211104093000.123Z", "2021-11-04T09:30:00Z", true},
+		{"202111040930Z", "2021-11-04T09:30:00Z", true},
+		{"2021110409Z", "2021-11-04T09:00:00Z", true},
+		{"20211104093000+0100", "2021-11-04T08:30:00Z", true},
+		{"20211104093000-0530", "2021-11-04T15:00:00Z", true},
+		{"20211304093000Z", "", false},
+		{"2021", "", false},
+		{"132809868000000000", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := decodeGeneralizedTime(tt.value)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestDecodeFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		attribute string
+		value     string
+		want      []string
+		ok        bool
+	}{
+		{"normal account", "userAccountControl", "512", []string{"NORMAL_ACCOUNT"}, true},
+		{"disabled account with password which never expires", "userAccountControl", "66050", []string{"ACCOUNTDISABLE", "NORMAL_ACCOUNT", "DONT_EXPIRE_PASSWORD"}, true},
+		{"unnamed bits are kept", "userAccountControl", "516", []string{"NORMAL_ACCOUNT", "0x00000004"}, true},
+		{"no flags", "userAccountControl", "0", []string{}, true},
+		{"computed flags", "msDS-User-Account-Control-Computed", "8388624", []string{"LOCKOUT", "PASSWORD_EXPIRED"}, true},
+		{"negative security group type", "groupType", "-2147483646", []string{"ACCOUNT_GROUP", "SECURITY_ENABLED"}, true},
+		{"distribution group type", "groupType", "8", []string{"UNIVERSAL_GROUP"}, true},
+		{"attribute options are ignored", "groupType;binary", "4", []string{"RESOURCE_GROUP"}, true},
+		{"largest unsigned value", "groupType", "4294967295", []string{"BUILTIN_LOCAL_GROUP", "ACCOUNT_GROUP", "RESOURCE_GROUP", "UNIVERSAL_GROUP", "APP_BASIC_GROUP", "APP_QUERY_GROUP", "SECURITY_ENABLED", "0x7FFFFFC0"}, true},
+		{"too large", "userAccountControl", "4294967296", nil, false},
+		{"too small", "groupType", "-2147483649", nil, false},
+		{"not a number", "userAccountControl", "NORMAL_ACCOUNT", nil, false},
+		{"not a bitmask", "sAMAccountType", "805306368", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decodeFlags(tt.attribute, tt.value)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestDecodeValues(t *testing.T) {
+	tests := []struct {
+		attribute string
+		values    []string
+		want      []string
+	}{
+		{"pwdLastSet", []string{"132809868000000000"}, []string{"2021-11-10T03:00:00Z"}},
+		{"accountExpires", []string{"9223372036854775807"}, []string{neverTimestamp}},
+		{"lastLogonTimestamp", []string{"0"}, []string{neverTimestamp}},
+		{"whenCreated", []string{"20211104093000.0Z"}, []string{"2021-11-04T09:30:00Z"}},
+		{"dSCorePropagationData", []string{"20211104093000.0Z", "16010101000000.0Z"}, []string{"2021-11-04T09:30:00Z", "1601-01-01T00:00:00Z"}},
+		{"sAMAccountType", []string{"805306368"}, []string{"SAM_USER_OBJECT"}},
+		{"sAMAccountType", []string{"805306369"}, []string{"SAM_MACHINE_ACCOUNT"}},
+		{"sAMAccountType", []string{"1"}, []string{"1"}},
+		{"pwdLastSet", []string{"garbage"}, []string{"garbage"}},
+		{"cn", []string{"132809868000000000"}, []string{"132809868000000000"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.attribute, func(t *testing.T) {
+			if got := decodeValues(tt.attribute, tt.values); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// apiKey is a key which callers can authenticate with.
+// Only the SHA-256 hash of the key is kept in the config, so that the config doesn't give away the keys themselves.
+type apiKey struct {
+	Name   string `json:"name" yaml:"name" toml:"name"`
+	SHA256 string `json:"sha256" yaml:"sha256" toml:"sha256"`
+}
+
+// parseAPIKeys parses API keys given as a comma separated list of name:sha256 pairs, as used by the flag and environment variable
+func parseAPIKeys(value string) ([]apiKey, error) {
+	var keys []apiKey
+
+	for _, v := range splitList(value) {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("API key %q MUST be in the form name:sha256", v)
+		}
+
+		keys = append(keys, apiKey{
+			Name:   strings.TrimSpace(parts[0]),
+			SHA256: strings.TrimSpace(parts[1]),
+		})
+	}
+
+	return keys, nil
+}
+
+// validateAPIKeys ensures that every key has a unique name and a valid hash
+func validateAPIKeys(keys []apiKey) []error {
+	var errs []error
+
+	names := make(map[string]bool)
+
+	for i, k := range keys {
+		if k.Name == "" {
+			errs = append(errs, fmt.Errorf("api_keys[%d]: name is required", i))
+		}
+
+		if names[k.Name] {
+			errs = append(errs, fmt.Errorf("api_keys[%d]: name %q is used more than once", i, k.Name))
+		}
+		names[k.Name] = true
+
+		hash, err := hex.DecodeString(k.SHA256)
+		if err != nil || len(hash) != sha256.Size {
+			errs = append(errs, fmt.Errorf("api_keys[%d]: sha256 MUST be the hex encoded SHA-256 hash of the key", i))
+		}
+	}
+
+	return errs
+}
+
+// requestAPIKey returns the API key sent with the request, if any
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	return bearerToken(r)
+}
+
+// bearerToken returns the token from the Authorization header, if it is a bearer token
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(parts[1])
+}
+
+// matchAPIKey returns the name of the API key which matches key.
+// The hashes are compared in constant time, and every key is checked, so that the time taken doesn't give away how close a guess was.
+func matchAPIKey(keys []apiKey, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+
+	hash := sha256.Sum256([]byte(key))
+
+	name := ""
+	found := false
+
+	for _, k := range keys {
+		expected, err := hex.DecodeString(k.SHA256)
+		if err != nil {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(hash[:], expected) == 1 && !found {
+			name = k.Name
+			found = true
+		}
+	}
+
+	return name, found
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/justinas/alice"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// authenticate ensures that the caller has authenticated using one of the configured methods; an API key, or a JWT bearer token.
+// The name of the API key, or the subject of the token, is stored in the request context to identify the caller in logs and metrics.
+// If no authentication methods are configured, every request is let through.
+func authenticate(keys []apiKey, verifier *jwtVerifier, logger *logrus.Entry) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 && verifier == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, method, err := identifyCaller(r, keys, verifier)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"client_ip": r.Context().Value(clientIPCtxKey),
+					"function":  "authenticate",
+					"method":    method,
+					"error":     err,
+				}).Warn("unable to authenticate request")
+
+				APIResponse := Response{
+					Message: "unable to authenticate request",
+					Error:   err.Error(),
+				}
+
+				// Valid tokens which lack the required scope are forbidden, rather than unauthenticated; see RFC 6750
+				if err == errInsufficientScope {
+					APIResponse.Message = "caller is not allowed to query"
+					w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+					APIResponse.Send(http.StatusForbidden, w)
+
+					return
+				}
+
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				APIResponse.Send(http.StatusUnauthorized, w)
+
+				return
+			}
+
+			logger.WithFields(logrus.Fields{
+				"client_ip": r.Context().Value(clientIPCtxKey),
+				"client":    client,
+				"function":  "authenticate",
+				"method":    method,
+			}).Debug("request authenticated")
+
+			ctx := context.WithValue(r.Context(), clientCtxKey, client)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// identifyCaller works out who the caller is from the credentials sent with the request, returning the method used to authenticate.
+// An API key can be sent in the X-API-Key header; a bearer token is treated as a JWT if it looks like one and JWTs are accepted, otherwise as an API key.
+func identifyCaller(r *http.Request, keys []apiKey, verifier *jwtVerifier) (string, string, error) {
+	token := bearerToken(r)
+
+	if r.Header.Get("X-API-Key") == "" && verifier != nil && strings.Count(token, ".") == 2 {
+		subject, err := verifier.verify(token)
+		return subject, "jwt", err
+	}
+
+	if len(keys) > 0 {
+		key := requestAPIKey(r)
+		if key == "" {
+			return "", "api_key", errors.New("an API key is required; send it in the X-API-Key header or as a bearer token")
+		}
+
+		name, ok := matchAPIKey(keys, key)
+		if !ok {
+			return "", "api_key", errors.New("invalid API key")
+		}
+
+		return name, "api_key", nil
+	}
+
+	return "", "jwt", errors.New("a bearer token is required")
+}
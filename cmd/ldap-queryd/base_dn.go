@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// Attribute types in a DN are either a name, e.g. OU, or an OID, e.g. 2.5.4.11; see RFC 4512 section 1.4
+var validAttributeType = regexp.MustCompile(`^(?:[A-Za-z][A-Za-z0-9-]*|[0-9]+(?:\.[0-9]+)*)$`)
+
+// parseDN parses a distinguished name, returning an error describing exactly what is wrong with it if it is not valid.
+// ldap.ParseDN accepts some strings which are not valid DNs, such as empty values and trailing commas, so those are checked for here.
+func parseDN(s string) (*ldap.DN, error) {
+	dn, err := ldap.ParseDN(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dn.RDNs) == 0 {
+		return nil, errors.New("no attribute=value pairs found")
+	}
+
+	err = checkDNEnding(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rdn := range dn.RDNs {
+		for _, attr := range rdn.Attributes {
+			if attr.Type == "" {
+				return nil, fmt.Errorf("RDN %d has an empty attribute type", i+1)
+			}
+
+			if !validAttributeType.MatchString(attr.Type) {
+				return nil, fmt.Errorf("RDN %d has an invalid attribute type %q", i+1, attr.Type)
+			}
+
+			if attr.Value == "" {
+				return nil, fmt.Errorf("RDN %d (%s) has an empty value", i+1, attr.Type)
+			}
+		}
+	}
+
+	return dn, nil
+}
+
+// checkDNEnding checks how the DN ends, ignoring any unescaped trailing spaces.
+// ldap.ParseDN silently ignores a trailing separator, empty value or dangling escape, dropping whatever was left incomplete,
+// so e.g. DC=corp,DC=local,DC= would otherwise be treated as DC=corp,DC=local.
+func checkDNEnding(s string) error {
+	var last byte
+	lastEscaped := false
+	escaping := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case escaping:
+			escaping = false
+			last = c
+			lastEscaped = true
+		case c == '\\':
+			escaping = true
+		case c == ' ':
+			continue
+		default:
+			last = c
+			lastEscaped = false
+		}
+	}
+
+	if escaping {
+		return errors.New("DN ends with an incomplete escape; a literal '\\' MUST be escaped as \\\\")
+	}
+
+	if lastEscaped {
+		return nil
+	}
+
+	switch last {
+	case ',':
+		return errors.New("DN ends with a trailing comma")
+	case '+':
+		return errors.New("DN ends with a trailing '+'")
+	case '=':
+		return errors.New("DN ends with an empty value")
+	}
+
+	return nil
+}
+
+// foldDN returns a copy of a DN with all values in lower case.
+// DN.Equal and DN.AncestorOf compare values case sensitively, but directories such as AD treat DNs as case insensitive.
+func foldDN(dn *ldap.DN) *ldap.DN {
+	folded := &ldap.DN{}
+
+	for _, rdn := range dn.RDNs {
+		r := &ldap.RelativeDN{}
+
+		for _, attr := range rdn.Attributes {
+			r.Attributes = append(r.Attributes, &ldap.AttributeTypeAndValue{
+				Type:  attr.Type,
+				Value: strings.ToLower(attr.Value),
+			})
+		}
+
+		folded.RDNs = append(folded.RDNs, r)
+	}
+
+	return folded
+}
+
+// withinNamingContexts checks whether a search base falls under one of the naming contexts configured for a directory.
+// If the directory does not have any naming contexts configured, any base is allowed.
+func (d directory) withinNamingContexts(base *ldap.DN) bool {
+	if len(d.namingContexts) == 0 {
+		return true
+	}
+
+	base = foldDN(base)
+
+	for _, nc := range d.namingContexts {
+		if nc.Equal(base) || nc.AncestorOf(base) {
+			return true
+		}
+	}
+
+	return false
+}
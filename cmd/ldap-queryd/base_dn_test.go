@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+func TestParseDN(t *testing.T) {
+	tests := []struct {
+		name string
+		dn   string
+		rdns int
+		err  string
+	}{
+		{name: "AD container", dn: "CN=Users,DC=corp,DC=local", rdns: 3},
+		{name: "single RDN", dn: "O=Example", rdns: 1},
+		{name: "OID attribute type", dn: "2.5.4.11=Users,DC=corp,DC=local", rdns: 3},
+		{name: "escaped comma in value", dn: `CN=Smith\, John,DC=corp,DC=local`, rdns: 3},
+		{name: "value ending in an escaped comma", dn: `CN=Smith\,`, rdns: 1},
+		{name: "multi-valued RDN", dn: "CN=a+UID=b,DC=corp", rdns: 2},
+		{name: "empty", dn: "", err: "no attribute=value pairs found"},
+		{name: "trailing comma", dn: "DC=corp,DC=local,", err: "DN ends with a trailing comma"},
+		{name: "trailing comma with spaces", dn: "DC=corp,DC=local, ", err: "DN ends with a trailing comma"},
+		{name: "trailing comma after escaped backslash", dn: `CN=a\\,`, err: "DN ends with a trailing comma"},
+		{name: "empty value", dn: "CN=,DC=corp", err: "RDN 1 (CN) has an empty value"},
+		{name: "value ending in an escaped space", dn: `CN=a\ ,DC=corp`, rdns: 2},
+		{name: "last value ending in an escaped space", dn: `CN=a\ `, rdns: 1},
+		{name: "value ending in an escaped equals sign", dn: `CN=a\=`, rdns: 1},
+		{name: "empty last value", dn: "CN=Users,DC=", err: "DN ends with an empty value"},
+		{name: "empty last value with spaces", dn: "CN=Users,DC=  ", err: "DN ends with an empty value"},
+		{name: "trailing plus", dn: "DC=corp,CN=a+", err: "DN ends with a trailing '+'"},
+		{name: "dangling escape", dn: `CN=a\`, err: `DN ends with an incomplete escape; a literal '\' MUST be escaped as \\`},
+		{name: "invalid attribute type", dn: "CN=Users,D_C=corp", err: `RDN 2 has an invalid attribute type "D_C"`},
+		{name: "attribute type starting with a digit", dn: "1CN=Users", err: `RDN 1 has an invalid attribute type "1CN"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dn, err := parseDN(tt.dn)
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected %q to be valid, got %v", tt.dn, err)
+				}
+
+				if len(dn.RDNs) != tt.rdns {
+					t.Errorf("expected %d RDNs, got %d", tt.rdns, len(dn.RDNs))
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected %q, but %q was accepted", tt.err, tt.dn)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("expected %q, got %q", tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestParseDNRejectsMalformed(t *testing.T) {
+	for _, dn := range []string{"Users", "CN=Users,DC", "=Users", `CN=a\zz`, "CN=#zz"} {
+		if _, err := parseDN(dn); err == nil {
+			t.Errorf("expected %q to be rejected", dn)
+		}
+	}
+}
+
+func TestWithinNamingContexts(t *testing.T) {
+	d := directory{}
+	for _, nc := range []string{"DC=corp,DC=local", "CN=Configuration,DC=lab,DC=local"} {
+		dn, err := parseDN(nc)
+		if err != nil {
+			t.Fatalf("unable to parse naming context %q: %v", nc, err)
+		}
+
+		d.namingContexts = append(d.namingContexts, foldDN(dn))
+	}
+
+	tests := []struct {
+		base   string
+		within bool
+	}{
+		{"DC=corp,DC=local", true},
+		{"OU=Staff,DC=corp,DC=local", true},
+		{"CN=Smith\\, John,OU=Staff,DC=corp,DC=local", true},
+		{"dc=CORP,dc=Local", true},
+		{"ou=staff,DC=Corp,DC=LOCAL", true},
+		{"CN=Schema,CN=Configuration,DC=lab,DC=local", true},
+		{"DC=local", false},
+		{"DC=lab,DC=local", false},
+		{"DC=notcorp,DC=local", false},
+		{"OU=corp,DC=local", false},
+		{"DC=corp,DC=local,DC=evil", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.base, func(t *testing.T) {
+			base, err := parseDN(tt.base)
+			if err != nil {
+				t.Fatalf("unable to parse base: %v", err)
+			}
+
+			if got := d.withinNamingContexts(base); got != tt.within {
+				t.Errorf("expected %v, got %v", tt.within, got)
+			}
+		})
+	}
+}
+
+func TestWithinNamingContextsAllowsAnyBaseWhenNoneConfigured(t *testing.T) {
+	base, _ := ldap.ParseDN("DC=anything,DC=example")
+
+	if !(directory{}).withinNamingContexts(base) {
+		t.Error("expected any base to be allowed when no naming contexts are configured")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+// The ways in which binary attribute values are rendered as strings in the response
+const (
+	binaryFormatNone = iota
+	binaryFormatBase64
+	binaryFormatGUID
+	binaryFormatSID
+)
+
+// binaryAttributes lists the AD attributes which hold binary values, keyed by lower case attribute name.
+// Any attributes not listed here can be added per directory using the binary_attributes setting, and are returned base64 encoded.
+var binaryAttributes = map[string]int{
+	"objectguid":                               binaryFormatGUID,
+	"msexchmailboxguid":                        binaryFormatGUID,
+	"msexcharchiveguid":                        binaryFormatGUID,
+	"ms-ds-consistencyguid":                    binaryFormatGUID,
+	"msds-consistencyguid":                     binaryFormatGUID,
+	"schemaidguid":                             binaryFormatGUID,
+	"attributesecurityguid":                    binaryFormatGUID,
+	"invocationid":                             binaryFormatGUID,
+	"objectsid":                                binaryFormatSID,
+	"sidhistory":                               binaryFormatSID,
+	"securityidentifier":                       binaryFormatSID,
+	"tokengroups":                              binaryFormatSID,
+	"tokengroupsglobalanduniversal":            binaryFormatSID,
+	"tokengroupsnogcacceptable":                binaryFormatSID,
+	"msexchmasteraccountsid":                   binaryFormatSID,
+	"ms-ds-creatorsid":                         binaryFormatSID,
+	"thumbnailphoto":                           binaryFormatBase64,
+	"jpegphoto":                                binaryFormatBase64,
+	"photo":                                    binaryFormatBase64,
+	"audio":                                    binaryFormatBase64,
+	"usercertificate":                          binaryFormatBase64,
+	"usersmimecertificate":                     binaryFormatBase64,
+	"userpkcs12":                               binaryFormatBase64,
+	"cacertificate":                            binaryFormatBase64,
+	"crosscertificatepair":                     binaryFormatBase64,
+	"certificaterevocationlist":                binaryFormatBase64,
+	"authorityrevocationlist":                  binaryFormatBase64,
+	"deltarevocationlist":                      binaryFormatBase64,
+	"msexchblockedsendershash":                 binaryFormatBase64,
+	"msexchsafesendershash":                    binaryFormatBase64,
+	"msexchsaferecipientshash":                 binaryFormatBase64,
+	"ntsecuritydescriptor":                     binaryFormatBase64,
+	"msds-allowedtoactonbehalfofotheridentity": binaryFormatBase64,
+	"msds-generationid":                        binaryFormatBase64,
+	"msds-keycredentiallink":                   binaryFormatBase64,
+	"logonhours":                               binaryFormatBase64,
+	"dnsrecord":                                binaryFormatBase64,
+	"repluptodatevector":                       binaryFormatBase64,
+	"repsfrom":                                 binaryFormatBase64,
+	"repsto":                                   binaryFormatBase64,
+	"terminalserver":                           binaryFormatBase64,
+}
+
+// binaryFormat works out how the values of an attribute should be rendered.
+// Attribute options, such as ;binary, are ignored when looking the attribute up, but an attribute requested with ;binary is always treated as binary.
+func (d directory) binaryFormat(attribute string) int {
+	name, options := splitAttributeOptions(attribute)
+	name = strings.ToLower(name)
+
+	if format, ok := binaryAttributes[name]; ok {
+		return format
+	}
+
+	for _, a := range d.BinaryAttributes {
+		if strings.ToLower(a) == name {
+			return binaryFormatBase64
+		}
+	}
+
+	for _, o := range options {
+		if strings.ToLower(o) == "binary" {
+			return binaryFormatBase64
+		}
+	}
+
+	return binaryFormatNone
+}
+
+// splitAttributeOptions separates an attribute description, such as userCertificate;binary, into the attribute name and its options
+func splitAttributeOptions(attribute string) (string, []string) {
+	parts := strings.Split(attribute, ";")
+
+	return parts[0], parts[1:]
+}
+
+// attributeValues returns the values of an attribute as strings, with binary values rendered according to their format.
+//
+// Directories do not always return an attribute under exactly the name it was requested with; AD, for example, drops the ;binary option.
+// If there is no exact match, an attribute with the same name, ignoring case and options, is used instead.
+func attributeValues(entry *ldap.Entry, attribute string, directory directory) []string {
+	attr := findAttribute(entry, attribute)
+	if attr == nil {
+		return nil
+	}
+
+	format := directory.binaryFormat(attribute)
+	if format == binaryFormatNone {
+		return attr.Values
+	}
+
+	values := make([]string, len(attr.ByteValues))
+	for i, v := range attr.ByteValues {
+		values[i] = formatBinaryValue(v, format)
+	}
+
+	return values
+}
+
+func findAttribute(entry *ldap.Entry, attribute string) *ldap.EntryAttribute {
+	for _, attr := range entry.Attributes {
+		if attr.Name == attribute {
+			return attr
+		}
+	}
+
+	name, _ := splitAttributeOptions(attribute)
+
+	for _, attr := range entry.Attributes {
+		n, _ := splitAttributeOptions(attr.Name)
+		if strings.EqualFold(n, name) {
+			return attr
+		}
+	}
+
+	return nil
+}
+
+// rawValues returns the values of an attribute exactly as the directory sent them, finding the attribute in the same way as attributeValues
+func rawValues(entry *ldap.Entry, attribute string) []string {
+	attr := findAttribute(entry, attribute)
+	if attr == nil {
+		return nil
+	}
+
+	return attr.Values
+}
+
+// formatBinaryValue renders a binary value as a string.
+// Values which are not valid for the format, e.g. a GUID which isn't 16 bytes long, fall back to base64 so that nothing is lost.
+func formatBinaryValue(value []byte, format int) string {
+	switch format {
+	case binaryFormatGUID:
+		if s, ok := formatGUID(value); ok {
+			return s
+		}
+	case binaryFormatSID:
+		if s, ok := formatSID(value); ok {
+			return s
+		}
+	}
+
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+// formatGUID renders a GUID in its canonical string form, e.g. 3f2504e0-4f89-11d3-9a0c-0305e82c3301.
+// AD stores GUIDs in the Microsoft byte order, where the first three fields are little endian.
+func formatGUID(b []byte) (string, bool) {
+	if len(b) != 16 {
+		return "", false
+	}
+
+	return fmt.Sprintf(
+		"%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10],
+		b[10:16],
+	), true
+}
+
+// formatSID renders a security identifier in its string form, e.g. S-1-5-21-3623811015-3361044348-30300820-1013.
+// The binary form is a revision byte, a count of sub-authorities, a 48-bit big endian identifier authority, and then the little endian 32-bit sub-authorities.
+func formatSID(b []byte) (string, bool) {
+	if len(b) < 8 {
+		return "", false
+	}
+
+	count := int(b[1])
+	if len(b) != 8+4*count {
+		return "", false
+	}
+
+	var authority uint64
+	for _, v := range b[2:8] {
+		authority = authority<<8 | uint64(v)
+	}
+
+	// Identifier authorities which don't fit in 32 bits are written in hex; see MS-DTYP section 2.4.2.1
+	var sid strings.Builder
+	if authority >= 1<<32 {
+		fmt.Fprintf(&sid, "S-%d-0x%012X", b[0], authority)
+	} else {
+		fmt.Fprintf(&sid, "S-%d-%d", b[0], authority)
+	}
+
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&sid, "-%d", binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+
+	return sid.String(), true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+var testGUID = []byte{0xe0, 0x04, 0x25, 0x3f, 0x89, 0x4f, 0xd3, 0x11, 0x9a, 0x0c, 0x03, 0x05, 0xe8, 0x2c, 0x33, 0x01}
+
+var testSID = []byte{
+	0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05,
+	0x15, 0x00, 0x00, 0x00,
+	0xc7, 0xf7, 0xfe, 0xd7,
+	0x7c, 0x77, 0x55, 0xc8,
+	0x94, 0x5a, 0xce, 0x01,
+	0xf5, 0x03, 0x00, 0x00,
+}
+
+func TestFormatBinaryValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  []byte
+		format int
+		want   string
+	}{
+		{"GUID in Microsoft byte order", testGUID, binaryFormatGUID, "3f2504e0-4f89-11d3-9a0c-0305e82c3301"},
+		{"GUID which is too short", testGUID[:15], binaryFormatGUID, "4AQlP4lP0xGaDAMF6Cwz"},
+		{"GUID which is too long", append(append([]byte{}, testGUID...), 0x00), binaryFormatGUID, "4AQlP4lP0xGaDAMF6CwzAQA="},
+		{"domain SID", testSID, binaryFormatSID, "S-1-5-21-3623811015-3361044348-30300820-1013"},
+		{"builtin SID", []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x20, 0x00, 0x00, 0x00, 0x20, 0x02, 0x00, 0x00}, binaryFormatSID, "S-1-5-32-544"},
+		{"SID with the largest decimal identifier authority", []byte{0x01, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff}, binaryFormatSID, "S-1-4294967295"},
+		{"SID without sub-authorities", []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, binaryFormatSID, "S-1-1"},
+		{"SID with a large identifier authority", []byte{0x01, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06}, binaryFormatSID, "S-1-0x010203040506"},
+		{"SID shorter than its sub-authority count", testSID[:len(testSID)-1], binaryFormatSID, "AQUAAAAAAAUVAAAAx/f+13x3VciUWs4B9QMA"},
+		{"SID shorter than its header", []byte{0x01, 0x00, 0x00}, binaryFormatSID, "AQAA"},
+		{"base64", []byte{0xff, 0xd8, 0xff, 0xe0}, binaryFormatBase64, "/9j/4A=="},
+		{"empty value", []byte{}, binaryFormatBase64, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatBinaryValue(tt.value, tt.format); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBinaryFormat(t *testing.T) {
+	d := directory{BinaryAttributes: []string{"msDS-CustomBlob"}}
+
+	tests := []struct {
+		attribute string
+		want      int
+	}{
+		{"objectGUID", binaryFormatGUID},
+		{"OBJECTGUID", binaryFormatGUID},
+		{"objectSid", binaryFormatSID},
+		{"sIDHistory", binaryFormatSID},
+		{"thumbnailPhoto", binaryFormatBase64},
+		{"userCertificate;binary", binaryFormatBase64},
+		{"objectGUID;binary", binaryFormatGUID},
+		{"msds-customblob", binaryFormatBase64},
+		{"msDS-CustomBlob;range=0-10", binaryFormatBase64},
+		{"someAttribute;binary", binaryFormatBase64},
+		{"someAttribute;BINARY", binaryFormatBase64},
+		{"someAttribute;lang-en", binaryFormatNone},
+		{"cn", binaryFormatNone},
+		{"binary", binaryFormatNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.attribute, func(t *testing.T) {
+			if got := d.binaryFormat(tt.attribute); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAttributeValues(t *testing.T) {
+	entry := &ldap.Entry{
+		DN: "CN=user01,CN=Users,DC=corp,DC=local",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "cn", Values: []string{"user01"}, ByteValues: [][]byte{[]byte("user01")}},
+			{Name: "objectGUID", Values: []string{string(testGUID)}, ByteValues: [][]byte{testGUID}},
+			{Name: "objectSid", Values: []string{string(testSID)}, ByteValues: [][]byte{testSID}},
+			// AD drops the ;binary option when returning the attribute
+			{Name: "userCertificate", Values: []string{"\x30\x82"}, ByteValues: [][]byte{{0x30, 0x82}}},
+		},
+	}
+
+	tests := []struct {
+		attribute string
+		want      []string
+	}{
+		{"cn", []string{"user01"}},
+		{"CN", []string{"user01"}},
+		{"objectGUID", []string{"3f2504e0-4f89-11d3-9a0c-0305e82c3301"}},
+		{"objectguid", []string{"3f2504e0-4f89-11d3-9a0c-0305e82c3301"}},
+		{"objectSid", []string{"S-1-5-21-3623811015-3361044348-30300820-1013"}},
+		{"userCertificate;binary", []string{"MII="}},
+		{"mail", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.attribute, func(t *testing.T) {
+			if got := attributeValues(entry, tt.attribute, directory{}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
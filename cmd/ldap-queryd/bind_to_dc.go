@@ -10,9 +10,10 @@ import (
 	"gopkg.in/ldap.v3"
 )
 
-//TODO Allow TLS bind
-func bindToDC(directory directory, logger *logrus.Entry) (*ldap.Conn, error) {
+// bindToDC connects and binds to one of the directory servers, returning the connection along with the host it is connected to
+func bindToDC(directory directory, logger *logrus.Entry) (*ldap.Conn, string, error) {
 	var ldapConn *ldap.Conn
+	var host string
 
 	// Randomise the selection of hosts to allow for rudimentary load balancing of requests
 	r := rand.New(rand.NewSource(time.Now().Unix()))
@@ -21,40 +22,73 @@ func bindToDC(directory directory, logger *logrus.Entry) (*ldap.Conn, error) {
 		ds := directory.Hosts[i]
 
 		logger.WithFields(logrus.Fields{
-			"ds":   ds,
-			"port": directory.Port,
+			"directory": directory.Name,
+			"ds":        ds,
+			"port":      directory.Port,
+			"tls":       directory.TLSMode,
 		}).Debug("attempting to connect to directory")
 
 		var err error
 
-		ldapConn, err = ldap.Dial("tcp", fmt.Sprintf("%s:%d", ds, directory.Port))
+		ldapConn, err = dialDC(directory, ds)
 		if err != nil {
 			logger.WithFields(logrus.Fields{
-				"DC":       ds,
-				"port":     directory.Port,
-				"function": "bindToDC",
-				"error":    err,
+				"directory": directory.Name,
+				"DC":        ds,
+				"port":      directory.Port,
+				"tls":       directory.TLSMode,
+				"function":  "bindToDC",
+				"error":     err,
 			}).Error("unable to dial LDAP directory server")
 
 			continue
 		}
 
+		host = ds
+
 		break
 	}
 
 	if ldapConn == nil {
-		return nil, errors.New("unable to open connection to directory")
+		return nil, "", errors.New("unable to open connection to directory")
 	}
 
 	err := ldapConn.Bind(directory.BindDN, directory.BindPW)
 	if err != nil {
+		ldapConn.Close()
+
 		// Let's ensure we return a friendly error message if available
 		if err, ok := err.(*ldap.Error); ok {
-			return nil, errors.New(ldap.LDAPResultCodeMap[err.ResultCode])
+			return nil, "", errors.New(ldap.LDAPResultCodeMap[err.ResultCode])
 		}
 
-		return nil, errors.Wrap(err, "unable to bind to directory")
+		return nil, "", errors.Wrap(err, "unable to bind to directory")
 	}
 
-	return ldapConn, nil
+	return ldapConn, host, nil
+}
+
+// dialDC opens a connection to a single directory server, securing it with TLS if the directory has been configured to do so
+func dialDC(directory directory, host string) (*ldap.Conn, error) {
+	address := fmt.Sprintf("%s:%d", host, directory.Port)
+
+	switch directory.TLSMode {
+	case tlsModeLDAPS:
+		return ldap.DialTLS("tcp", address, directory.tlsConfigForHost(host))
+	case tlsModeStartTLS:
+		ldapConn, err := ldap.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ldapConn.StartTLS(directory.tlsConfigForHost(host))
+		if err != nil {
+			ldapConn.Close()
+			return nil, errors.Wrap(err, "unable to negotiate StartTLS")
+		}
+
+		return ldapConn, nil
+	default:
+		return ldap.Dial("tcp", address)
+	}
 }
@@ -2,26 +2,33 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/justinas/alice"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-func checkRequestSource(allowedSources []string, logger *logrus.Entry) alice.Constructor {
+// checkRequestSource only lets requests through from a client IP which falls within one of the allowed networks, and none of the denied networks.
+// The networks are parsed from the config at startup; see parseSources.
+// If there are no allowed networks, callers are identified in some other way, such as an API key, so any source which isn't denied is let through.
+func checkRequestSource(allowed []*net.IPNet, denied []*net.IPNet, logger *logrus.Entry) alice.Constructor {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			allowed := false
+			clientIP, _ := r.Context().Value(clientIPCtxKey).(string)
 
-			for _, ip := range allowedSources {
-				if ip == r.Context().Value(clientIPCtxKey) {
-					allowed = true
-					break
-				}
-			}
+			// IPv6 link local addresses can include a zone, e.g. fe80::1%eth0, which is not part of the IP
+			ip := net.ParseIP(strings.SplitN(clientIP, "%", 2)[0])
+
+			if ip == nil || (len(allowed) > 0 && !containsIP(allowed, ip)) || containsIP(denied, ip) {
+				logger.WithFields(logrus.Fields{
+					"client_ip": clientIP,
+					"function":  "checkRequestSource",
+				}).Debug("request source is not allowed")
 
-			if !allowed {
-				msg := fmt.Sprintf("%s is not allowed to query; check the config", r.Context().Value(clientIPCtxKey))
+				msg := fmt.Sprintf("%s is not allowed to query; check the config", clientIP)
 				APIResponse := Response{
 					Message: msg,
 				}
@@ -35,3 +42,56 @@ func checkRequestSource(allowedSources []string, logger *logrus.Entry) alice.Con
 		})
 	}
 }
+
+// containsIP checks whether the IP falls within any of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseSources turns each entry of a source list into the networks it covers.
+// An entry can be a CIDR range, such as 10.1.0.0/16 or fd00::/8, a single IPv4 or IPv6 address, or a hostname.
+// Hostnames are resolved once, at startup, to every address they have at the time.
+func parseSources(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, errors.Errorf("%q is not a valid CIDR range", e)
+			}
+
+			networks = append(networks, n)
+
+			continue
+		}
+
+		ips := []net.IP{net.ParseIP(e)}
+		if ips[0] == nil {
+			var err error
+
+			ips, err = net.LookupIP(e)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%q is not an IP address or CIDR range, and can't be resolved as a hostname", e)
+			}
+		}
+
+		for _, ip := range ips {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+
+	return networks, nil
+}
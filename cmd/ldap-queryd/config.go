@@ -1,65 +1,656 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v3"
+	"gopkg.in/yaml.v2"
 )
 
+// Environment variables which override settings in the config file are named after the flag for the setting, with this prefix.
+// For example, the directory_bind_pw flag can be set using the LDAPQUERY_DIRECTORY_BIND_PW environment variable.
+const envPrefix = "LDAPQUERY_"
+
+// Directory names are used in URLs, metric labels and environment variable names, so are restricted to a safe set of characters
+var validDirectoryName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 type config struct {
-	Server    server
+	Server server
+
+	// Directory holds the settings from the flags, environment variables and the directory section of the config file.
+	// It is served as a directory in its own right if it has any hosts.
 	Directory directory
+
+	// Directories holds every directory which is served, including the default directory; see loadConfig.
+	Directories []directory
 }
 
 type server struct {
-	Port               int
-	Debug              bool
-	AllowedSources     []string
-	CorsAllowedOrigins []string
-	CorsAllowedHeaders []string
+	Port               int      `json:"port" yaml:"port" toml:"port"`
+	Debug              bool     `json:"debug" yaml:"debug" toml:"debug"`
+	AllowedSources     []string `json:"allowed_sources" yaml:"allowed_sources" toml:"allowed_sources"`
+	DeniedSources      []string `json:"denied_sources" yaml:"denied_sources" toml:"denied_sources"`
+	TrustedProxies     []string `json:"trusted_proxies" yaml:"trusted_proxies" toml:"trusted_proxies"`
+	APIKeys            []apiKey `json:"api_keys" yaml:"api_keys" toml:"api_keys"`
+	JWTIssuer          string   `json:"jwt_issuer" yaml:"jwt_issuer" toml:"jwt_issuer"`
+	JWTAudience        string   `json:"jwt_audience" yaml:"jwt_audience" toml:"jwt_audience"`
+	JWTJWKS            string   `json:"jwt_jwks" yaml:"jwt_jwks" toml:"jwt_jwks"`
+	JWTRequiredScope   string   `json:"jwt_required_scope" yaml:"jwt_required_scope" toml:"jwt_required_scope"`
+	TLSCert            string   `json:"tls_cert" yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey             string   `json:"tls_key" yaml:"tls_key" toml:"tls_key"`
+	TLSClientCA        string   `json:"tls_client_ca" yaml:"tls_client_ca" toml:"tls_client_ca"`
+	TLSClientSubjects  []string `json:"tls_client_subjects" yaml:"tls_client_subjects" toml:"tls_client_subjects"`
+	CorsAllowedOrigins []string `json:"cors_allowed_origins" yaml:"cors_allowed_origins" toml:"cors_allowed_origins"`
+	CorsAllowedHeaders []string `json:"cors_allowed_headers" yaml:"cors_allowed_headers" toml:"cors_allowed_headers"`
+
+	// allowedNetworks, deniedNetworks and trustedProxies are parsed from AllowedSources, DeniedSources and TrustedProxies at startup; see parseSources
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+	trustedProxies  []*net.IPNet
+
+	// jwtVerifier is built from the JWT settings at startup, and is nil unless JWT authentication is configured; see newJWTVerifier
+	jwtVerifier *jwtVerifier
+
+	// tlsConfig is built from the TLS settings at startup, and is nil unless HTTPS is enabled; see newServerTLSConfig
+	tlsConfig *tls.Config
 }
 
 type directory struct {
-	Hosts  []string
-	BindDN string
-	BindPW string
-	Port   int
+	Name                  string   `json:"name" yaml:"name" toml:"name"`
+	Hosts                 []string `json:"hosts" yaml:"hosts" toml:"hosts"`
+	BindDN                string   `json:"bind_dn" yaml:"bind_dn" toml:"bind_dn"`
+	BindPW                string   `json:"bind_pw" yaml:"bind_pw" toml:"bind_pw"`
+	Port                  int      `json:"port" yaml:"port" toml:"port"`
+	TLSMode               string   `json:"tls_mode" yaml:"tls_mode" toml:"tls_mode"`
+	TLSCACert             string   `json:"tls_ca_cert" yaml:"tls_ca_cert" toml:"tls_ca_cert"`
+	TLSServerName         string   `json:"tls_server_name" yaml:"tls_server_name" toml:"tls_server_name"`
+	TLSInsecureSkipVerify bool     `json:"tls_insecure_skip_verify" yaml:"tls_insecure_skip_verify" toml:"tls_insecure_skip_verify"`
+	PoolMinIdle           int      `json:"pool_min_idle" yaml:"pool_min_idle" toml:"pool_min_idle"`
+	PoolMaxIdle           int      `json:"pool_max_idle" yaml:"pool_max_idle" toml:"pool_max_idle"`
+	PoolMaxActive         int      `json:"pool_max_active" yaml:"pool_max_active" toml:"pool_max_active"`
+	PoolMaxLifetime       duration `json:"pool_max_lifetime" yaml:"pool_max_lifetime" toml:"pool_max_lifetime"`
+	PoolWaitTimeout       duration `json:"pool_wait_timeout" yaml:"pool_wait_timeout" toml:"pool_wait_timeout"`
+	CursorTimeout         duration `json:"cursor_timeout" yaml:"cursor_timeout" toml:"cursor_timeout"`
+	MaxCursors            int      `json:"max_cursors" yaml:"max_cursors" toml:"max_cursors"`
+	BinaryAttributes      []string `json:"binary_attributes" yaml:"binary_attributes" toml:"binary_attributes"`
+	NamingContexts        []string `json:"naming_contexts" yaml:"naming_contexts" toml:"naming_contexts"`
+	ValidateAttributes    bool     `json:"validate_attributes" yaml:"validate_attributes" toml:"validate_attributes"`
+
+	// tlsConfig is built from the TLS settings at startup; see newDirectoryTLSConfig
+	tlsConfig *tls.Config
+
+	// namingContexts are parsed from NamingContexts at startup, with their values folded to lower case; see withinNamingContexts
+	namingContexts []*ldap.DN
 }
 
-func parseConfig(logger *logrus.Entry, allowedSources string, port int, debug bool, directoryHosts string, directoryBindDn string, directoryBindPwd string, directoryPort int, corsAllowedOrigins string, corsAllowedHeaders string) config {
-	sources := strings.Replace(allowedSources, " ", "", -1)
+// duration allows durations to be written in the config file in the same format as the flags, e.g. 30s or 5m
+type duration time.Duration
 
-	hosts := strings.Replace(directoryHosts, " ", "", -1)
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
 
-	var allowedOrigins []string
-	tmp := strings.Split(corsAllowedOrigins, ",")
-	for _, v := range tmp {
-		if strings.TrimSpace(v) == "" {
+	*d = duration(v)
+
+	return nil
+}
+
+// UnmarshalYAML is needed as the YAML package does not make use of UnmarshalText
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+
+	return d.UnmarshalText([]byte(s))
+}
+
+// The configuration flags are shared by all platforms.
+// The defaults given here are the defaults for the settings, but the flags themselves are only applied when explicitly set; see loadConfig.
+func init() {
+	flag.Int("port", 9999, "Port to listen for requests on")
+	flag.Bool("debug", false, "Enable debug logging")
+	flag.String("allowed_sources", "", "IPs, CIDR ranges or hostnames for sources that need to be able to make queries")
+	flag.String("denied_sources", "", "IPs, CIDR ranges or hostnames for sources which are never allowed to make queries, even if they are in allowed_sources")
+	flag.String("trusted_proxies", "", "IPs, CIDR ranges or hostnames of proxies whose Forwarded and X-Forwarded-For headers are used to find the client IP")
+	flag.String("api_keys", "", "API keys which callers can authenticate with, as name:sha256 pairs; the hash is the hex encoded SHA-256 hash of the key")
+	flag.String("jwt_issuer", "", "Issuer which JWT bearer tokens MUST be issued by")
+	flag.String("jwt_audience", "", "Audience which JWT bearer tokens MUST be issued for")
+	flag.String("jwt_jwks", "", "Path or URL of the JWKS holding the keys JWT bearer tokens are signed with")
+	flag.String("jwt_required_scope", "", "Scope which JWT bearer tokens MUST have to be allowed to query")
+	flag.String("tls_cert", "", "PEM encoded certificate to serve HTTPS with; the API is served over plain HTTP unless this and tls_key are set")
+	flag.String("tls_key", "", "PEM encoded private key for tls_cert")
+	flag.String("tls_client_ca", "", "PEM encoded CA bundle used to verify client certificates; if set, every client MUST present a certificate")
+	flag.String("tls_client_subjects", "", "Client certificate subjects, common names or SANs which are allowed to make queries; defaults to any certificate issued by tls_client_ca")
+	flag.String("directory_name", "default", "Name of the directory, used to select it in queries")
+	flag.String("directory_hosts", "", "LDAP hosts to query")
+	flag.String("directory_bind_dn", "", "DN of account used to bind to the directory")
+	flag.String("directory_bind_pw", "", "Password for account used to bind to the directory")
+	flag.Int("directory_port", 0, "Port to connect to the LDAP hosts on; defaults to 389, or 636 for LDAPS")
+	flag.String("directory_tls_mode", "none", "Secure the directory connection with TLS: none, ldaps, or starttls")
+	flag.String("directory_tls_ca_cert", "", "PEM encoded CA bundle used to verify the directory certificate; defaults to the system roots")
+	flag.String("directory_tls_server_name", "", "Override the server name used to verify the directory certificate")
+	flag.Bool("directory_tls_insecure_skip_verify", false, "Do NOT verify the directory certificate; for testing only")
+	flag.Int("directory_pool_min_idle", 1, "Minimum number of idle connections to keep open to the directory")
+	flag.Int("directory_pool_max_idle", 4, "Maximum number of idle connections to keep open to the directory")
+	flag.Int("directory_pool_max_active", 20, "Maximum number of connections to the directory which can be in use at once")
+	flag.Duration("directory_pool_max_lifetime", 30*time.Minute, "Maximum time a directory connection is reused for; 0 for no limit")
+	flag.Duration("directory_pool_wait_timeout", 10*time.Second, "Maximum time to wait for a free directory connection")
+	flag.Duration("directory_cursor_timeout", 5*time.Minute, "Maximum time between requests for the pages of a paged search before its cursor expires")
+	flag.Int("directory_max_cursors", 5, "Maximum number of paged search cursors, each holding a directory connection, kept at once; the oldest is dropped to make room for a new one")
+	flag.String("directory_binary_attributes", "", "Additional attributes holding binary values, returned base64 encoded")
+	flag.String("directory_naming_contexts", "", "Naming contexts which search bases MUST fall under; defaults to no restriction")
+	flag.Bool("directory_validate_attributes", false, "Warn about attributes in queries which are not defined in the directory schema")
+	flag.String("cors-allowed-origins", "", "Allowed origins for CORS purposes")
+	flag.String("cors-allowed-headers", "*", "Allowed headers for CORS purposes")
+}
+
+// settings maps the name of each configuration flag to the function which applies a value for it.
+// The same functions are used for flag defaults, environment variables and flags so that values are interpreted consistently.
+var settings = map[string]func(c *config, value string) error{
+	"port": func(c *config, value string) (err error) {
+		c.Server.Port, err = strconv.Atoi(value)
+		return err
+	},
+	"debug": func(c *config, value string) (err error) {
+		c.Server.Debug, err = strconv.ParseBool(value)
+		return err
+	},
+	"allowed_sources": func(c *config, value string) error {
+		c.Server.AllowedSources = splitList(value)
+		return nil
+	},
+	"denied_sources": func(c *config, value string) error {
+		c.Server.DeniedSources = splitList(value)
+		return nil
+	},
+	"trusted_proxies": func(c *config, value string) error {
+		c.Server.TrustedProxies = splitList(value)
+		return nil
+	},
+	"api_keys": func(c *config, value string) (err error) {
+		c.Server.APIKeys, err = parseAPIKeys(value)
+		return err
+	},
+	"jwt_issuer": func(c *config, value string) error {
+		c.Server.JWTIssuer = value
+		return nil
+	},
+	"jwt_audience": func(c *config, value string) error {
+		c.Server.JWTAudience = value
+		return nil
+	},
+	"jwt_jwks": func(c *config, value string) error {
+		c.Server.JWTJWKS = value
+		return nil
+	},
+	"jwt_required_scope": func(c *config, value string) error {
+		c.Server.JWTRequiredScope = value
+		return nil
+	},
+	"tls_cert": func(c *config, value string) error {
+		c.Server.TLSCert = value
+		return nil
+	},
+	"tls_key": func(c *config, value string) error {
+		c.Server.TLSKey = value
+		return nil
+	},
+	"tls_client_ca": func(c *config, value string) error {
+		c.Server.TLSClientCA = value
+		return nil
+	},
+	"tls_client_subjects": func(c *config, value string) error {
+		c.Server.TLSClientSubjects = splitList(value)
+		return nil
+	},
+	"directory_name": func(c *config, value string) error {
+		c.Directory.Name = value
+		return nil
+	},
+	"directory_hosts": func(c *config, value string) error {
+		c.Directory.Hosts = splitList(value)
+		return nil
+	},
+	"directory_bind_dn": func(c *config, value string) error {
+		c.Directory.BindDN = value
+		return nil
+	},
+	"directory_bind_pw": func(c *config, value string) error {
+		c.Directory.BindPW = value
+		return nil
+	},
+	"directory_port": func(c *config, value string) (err error) {
+		c.Directory.Port, err = strconv.Atoi(value)
+		return err
+	},
+	"directory_tls_mode": func(c *config, value string) error {
+		c.Directory.TLSMode = value
+		return nil
+	},
+	"directory_tls_ca_cert": func(c *config, value string) error {
+		c.Directory.TLSCACert = value
+		return nil
+	},
+	"directory_tls_server_name": func(c *config, value string) error {
+		c.Directory.TLSServerName = value
+		return nil
+	},
+	"directory_tls_insecure_skip_verify": func(c *config, value string) (err error) {
+		c.Directory.TLSInsecureSkipVerify, err = strconv.ParseBool(value)
+		return err
+	},
+	"directory_pool_min_idle": func(c *config, value string) (err error) {
+		c.Directory.PoolMinIdle, err = strconv.Atoi(value)
+		return err
+	},
+	"directory_pool_max_idle": func(c *config, value string) (err error) {
+		c.Directory.PoolMaxIdle, err = strconv.Atoi(value)
+		return err
+	},
+	"directory_pool_max_active": func(c *config, value string) (err error) {
+		c.Directory.PoolMaxActive, err = strconv.Atoi(value)
+		return err
+	},
+	"directory_pool_max_lifetime": func(c *config, value string) error {
+		return c.Directory.PoolMaxLifetime.UnmarshalText([]byte(value))
+	},
+	"directory_pool_wait_timeout": func(c *config, value string) error {
+		return c.Directory.PoolWaitTimeout.UnmarshalText([]byte(value))
+	},
+	"directory_cursor_timeout": func(c *config, value string) error {
+		return c.Directory.CursorTimeout.UnmarshalText([]byte(value))
+	},
+	"directory_max_cursors": func(c *config, value string) (err error) {
+		c.Directory.MaxCursors, err = strconv.Atoi(value)
+		return err
+	},
+	"directory_binary_attributes": func(c *config, value string) error {
+		c.Directory.BinaryAttributes = splitList(value)
+		return nil
+	},
+	"directory_naming_contexts": func(c *config, value string) error {
+		c.Directory.NamingContexts = splitList(value)
+		return nil
+	},
+	"directory_validate_attributes": func(c *config, value string) (err error) {
+		c.Directory.ValidateAttributes, err = strconv.ParseBool(value)
+		return err
+	},
+	"cors-allowed-origins": func(c *config, value string) error {
+		c.Server.CorsAllowedOrigins = splitList(value)
+		return nil
+	},
+	"cors-allowed-headers": func(c *config, value string) error {
+		c.Server.CorsAllowedHeaders = splitList(value)
+		return nil
+	},
+}
+
+// loadConfig builds the application configuration.
+// Settings are applied in order of precedence, with later sources overriding earlier ones:
+// flag defaults < config file < LDAPQUERY_* environment variables < flags set on the command line.
+// Named directories from the config file start with the flag defaults only, and can then be overridden using LDAPQUERY_DIRECTORIES_<NAME>_*
+// environment variables; they never inherit anything from the default directory, so one directory's credentials can't be sent to another.
+func loadConfig(path string) (config, error) {
+	var c config
+
+	for name, apply := range settings {
+		err := apply(&c, flag.Lookup(name).DefValue)
+		if err != nil {
+			return c, errors.Wrapf(err, "invalid default value for %s", name)
+		}
+	}
+
+	defaults := c.Directory
+
+	var namedDirectories []func(d *directory) error
+
+	if path != "" {
+		var err error
+
+		namedDirectories, err = readConfigFile(path, &c)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	err := applyEnv(&c, envPrefix, "")
+	if err != nil {
+		return c, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		apply, ok := settings[f.Name]
+		if !ok || err != nil {
+			return
+		}
+
+		err = apply(&c, f.Value.String())
+		if err != nil {
+			err = errors.Wrapf(err, "invalid value for flag %s", f.Name)
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	if len(c.Directory.Hosts) > 0 {
+		c.Directories = append(c.Directories, c.Directory)
+	}
+
+	for i, decode := range namedDirectories {
+		d := config{Directory: defaults}
+
+		err := decode(&d.Directory)
+		if err != nil {
+			return c, errors.Wrapf(err, "unable to parse directories[%d] in config file %s", i, path)
+		}
+
+		if !validDirectoryName.MatchString(d.Directory.Name) {
+			return c, fmt.Errorf("directories[%d] in config file %s MUST have a name made up of letters, numbers, '-' and '_'", i, path)
+		}
+
+		prefix := envPrefix + "DIRECTORIES_" + strings.ToUpper(strings.Replace(d.Directory.Name, "-", "_", -1)) + "_"
+
+		err = applyEnv(&d, prefix, "directory_")
+		if err != nil {
+			return c, err
+		}
+
+		c.Directories = append(c.Directories, d.Directory)
+	}
+
+	for i := range c.Directories {
+		d := &c.Directories[i]
+
+		d.TLSMode = strings.ToLower(strings.TrimSpace(d.TLSMode))
+		if d.TLSMode == "" {
+			d.TLSMode = tlsModeNone
+		}
+
+		// If the port has not been explicitly set, use the standard port for the type of connection
+		if d.Port == 0 {
+			d.Port = 389
+
+			if d.TLSMode == tlsModeLDAPS {
+				d.Port = 636
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// applyEnv applies settings from environment variables.
+// Only settings whose name starts with group are applied; the variable name is the prefix followed by the remainder of the setting name.
+func applyEnv(c *config, prefix string, group string) error {
+	for name, apply := range settings {
+		if !strings.HasPrefix(name, group) {
+			continue
+		}
+
+		env := prefix + strings.ToUpper(strings.Replace(strings.TrimPrefix(name, group), "-", "_", -1))
+
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		err := apply(c, value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid value for environment variable %s", env)
+		}
+	}
+
+	return nil
+}
+
+// readConfigFile decodes the config file at path on top of the existing configuration; the format is determined by the file extension.
+// A function is returned for each of the named directories, which decodes the settings for that directory on top of the directory passed to it.
+func readConfigFile(path string, c *config) ([]func(d *directory) error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read config file")
+	}
+
+	var namedDirectories []func(d *directory) error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		file := struct {
+			Server      *server         `yaml:"server"`
+			Directory   *directory      `yaml:"directory"`
+			Directories []yaml.MapSlice `yaml:"directories"`
+		}{
+			Server:    &c.Server,
+			Directory: &c.Directory,
+		}
+
+		err = yaml.UnmarshalStrict(data, &file)
+
+		for _, raw := range file.Directories {
+			raw := raw
+
+			namedDirectories = append(namedDirectories, func(d *directory) error {
+				data, err := yaml.Marshal(raw)
+				if err != nil {
+					return err
+				}
+
+				return yaml.UnmarshalStrict(data, d)
+			})
+		}
+	case ".json":
+		file := struct {
+			Server      *server           `json:"server"`
+			Directory   *directory        `json:"directory"`
+			Directories []json.RawMessage `json:"directories"`
+		}{
+			Server:    &c.Server,
+			Directory: &c.Directory,
+		}
+
+		err = decodeJSONStrict(data, &file)
+
+		for _, raw := range file.Directories {
+			raw := raw
+
+			namedDirectories = append(namedDirectories, func(d *directory) error {
+				return decodeJSONStrict(raw, d)
+			})
+		}
+	case ".toml":
+		file := struct {
+			Server      *server          `toml:"server"`
+			Directory   *directory       `toml:"directory"`
+			Directories []toml.Primitive `toml:"directories"`
+		}{
+			Server:    &c.Server,
+			Directory: &c.Directory,
+		}
+
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), &file)
+		if err == nil {
+			err = checkTOMLDecoded(md, "directories")
+		}
+
+		// The settings for the named directories are only marked as decoded once they have all been decoded
+		remaining := len(file.Directories)
+
+		for _, raw := range file.Directories {
+			raw := raw
+
+			namedDirectories = append(namedDirectories, func(d *directory) error {
+				err := md.PrimitiveDecode(raw, d)
+				if err != nil {
+					return err
+				}
+
+				remaining--
+				if remaining > 0 {
+					return nil
+				}
+
+				return checkTOMLDecoded(md, "")
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q; use .yaml, .yml, .json or .toml", filepath.Ext(path))
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse config file %s", path)
+	}
+
+	return namedDirectories, nil
+}
+
+// decodeJSONStrict decodes JSON, rejecting any unknown settings rather than silently ignoring them
+func decodeJSONStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(v)
+}
+
+// checkTOMLDecoded rejects any unknown settings in a TOML file, rather than silently ignoring them.
+// Settings in the skip section are not checked.
+func checkTOMLDecoded(md toml.MetaData, skip string) error {
+	for _, key := range md.Undecoded() {
+		if len(key) > 0 && key[0] == skip {
 			continue
 		}
 
-		allowedOrigins = append(allowedOrigins, strings.TrimSpace(v))
+		return fmt.Errorf("unknown setting %s", key)
 	}
 
-	var allowedHeaders []string
-	tmp = strings.Split(corsAllowedHeaders, ",")
-	for _, v := range tmp {
-		allowedHeaders = append(allowedHeaders, strings.TrimSpace(v))
+	return nil
+}
+
+// validate ensures that all required settings have been provided and that the settings which have been provided make sense.
+// The TLS configuration for each directory is also built, as that is where any problems with the TLS settings are found.
+func (c *config) validate() []error {
+	var errs []error
+
+	errs = append(errs, validateAPIKeys(c.Server.APIKeys)...)
+
+	var err error
+
+	c.Server.jwtVerifier, err = newJWTVerifier(c.Server)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid JWT configuration"))
+	}
+
+	c.Server.tlsConfig, err = newServerTLSConfig(c.Server)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid server TLS configuration"))
 	}
 
-	return config{
-		Server: server{
-			Port:               port,
-			Debug:              debug,
-			AllowedSources:     strings.Split(sources, ","),
-			CorsAllowedOrigins: allowedOrigins,
-			CorsAllowedHeaders: allowedHeaders,
-		},
-		Directory: directory{
-			Hosts:  strings.Split(hosts, ","),
-			BindDN: directoryBindDn,
-			BindPW: directoryBindPwd,
-			Port:   directoryPort,
-		},
+	// Callers MUST be identified somehow; by their source IP, or by authenticating
+	if len(c.Server.AllowedSources) == 0 && len(c.Server.APIKeys) == 0 && c.Server.JWTIssuer == "" && c.Server.TLSClientCA == "" {
+		errs = append(errs, errors.New("allowed_sources is required, unless api_keys, JWT authentication or client certificates are configured"))
 	}
+
+	c.Server.allowedNetworks, err = parseSources(c.Server.AllowedSources)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid allowed_sources"))
+	}
+
+	c.Server.deniedNetworks, err = parseSources(c.Server.DeniedSources)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid denied_sources"))
+	}
+
+	c.Server.trustedProxies, err = parseSources(c.Server.TrustedProxies)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid trusted_proxies"))
+	}
+
+	if len(c.Directories) == 0 {
+		errs = append(errs, errors.New("directory_hosts, or at least one named directory in the config file, is required"))
+	}
+
+	names := make(map[string]bool)
+
+	for i := range c.Directories {
+		d := &c.Directories[i]
+
+		if !validDirectoryName.MatchString(d.Name) {
+			errs = append(errs, fmt.Errorf("directory name %q MUST be made up of letters, numbers, '-' and '_'", d.Name))
+		}
+
+		if names[d.Name] {
+			errs = append(errs, fmt.Errorf("directory name %q is used more than once", d.Name))
+		}
+		names[d.Name] = true
+
+		if len(d.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("directory %q: hosts is required", d.Name))
+		}
+
+		if d.BindDN == "" {
+			errs = append(errs, fmt.Errorf("directory %q: bind_dn is required", d.Name))
+		}
+
+		if d.BindPW == "" {
+			errs = append(errs, fmt.Errorf("directory %q: bind_pw is required", d.Name))
+		}
+
+		err := validatePoolConfig(*d)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "directory %q: invalid connection pool configuration", d.Name))
+		}
+
+		d.tlsConfig, err = newDirectoryTLSConfig(*d)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "directory %q: invalid TLS configuration", d.Name))
+		}
+
+		d.namingContexts = nil
+		for _, nc := range d.NamingContexts {
+			dn, err := parseDN(nc)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "directory %q: naming context %q is not a valid DN", d.Name, nc))
+				continue
+			}
+
+			d.namingContexts = append(d.namingContexts, foldDN(dn))
+		}
+	}
+
+	return errs
+}
+
+// splitList turns a comma separated list into a slice, ignoring any whitespace and empty entries
+func splitList(list string) []string {
+	var items []string
+
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+
+		items = append(items, strings.TrimSpace(v))
+	}
+
+	return items
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// Connections which have been sitting idle for longer than this are checked to make sure they are still alive before being handed out.
+// Directory servers will drop idle connections (AD defaults to 15 minutes), and we'd rather find that out here than in the middle of a search.
+const healthCheckAfterIdle = 30 * time.Second
+
+// How often the pool is checked for expired connections and topped back up to the minimum number of idle connections.
+const poolMaintenanceInterval = 30 * time.Second
+
+var (
+	poolConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldapquery_pool_connections",
+			Help: "Number of directory connections in the pool, partitioned by directory and state",
+		},
+		[]string{
+			"directory",
+			"state",
+		},
+	)
+
+	poolWaitDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "ldapquery_pool_wait_duration_seconds",
+			Help: "Time spent waiting for a free directory connection from the pool, partitioned by directory",
+		},
+		[]string{
+			"directory",
+		},
+	)
+
+	poolCursors = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ldapquery_pool_cursors",
+			Help: "Number of paged search cursors holding a directory connection, partitioned by directory",
+		},
+		[]string{
+			"directory",
+		},
+	)
+
+	poolErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ldapquery_pool_errors_total",
+			Help: "Count of errors when managing pooled directory connections, partitioned by directory and operation",
+		},
+		[]string{
+			"directory",
+			"operation",
+		},
+	)
+)
+
+// pooledConn is a bound directory connection which can be reused across requests
+type pooledConn struct {
+	*ldap.Conn
+
+	// host is the directory server the connection is to
+	host string
+
+	created  time.Time
+	lastUsed time.Time
+}
+
+// connPool hands out bound directory connections, reusing them where possible rather than dialling and binding for every request.
+// The number of connections which can be in use at once is limited by slots; once they are all taken, callers wait for one to be returned.
+// Up to PoolMaxIdle connections are kept open between requests, on top of those in use.
+type connPool struct {
+	directory directory
+	logger    *logrus.Entry
+
+	slots chan struct{}
+
+	mu       sync.Mutex
+	idle     []*pooledConn
+	cursors  map[string]*cursor
+	rootDSEs map[string]cachedRootDSE
+
+	cachedSchema cachedSchema
+}
+
+// validatePoolConfig ensures that the pool settings for a directory make sense
+func validatePoolConfig(directory directory) error {
+	if directory.PoolMaxActive < 1 {
+		return errors.New("the maximum number of active connections MUST be at least 1")
+	}
+
+	if directory.PoolMinIdle < 0 || directory.PoolMaxIdle < 0 {
+		return errors.New("the number of idle connections cannot be negative")
+	}
+
+	if directory.PoolMinIdle > directory.PoolMaxIdle {
+		return errors.New("the minimum number of idle connections cannot be more than the maximum")
+	}
+
+	if directory.PoolWaitTimeout <= 0 {
+		return errors.New("the pool wait timeout MUST be greater than 0")
+	}
+
+	if directory.PoolMaxLifetime < 0 {
+		return errors.New("the maximum connection lifetime cannot be negative; use 0 for no limit")
+	}
+
+	if directory.CursorTimeout <= 0 {
+		return errors.New("the cursor timeout MUST be greater than 0")
+	}
+
+	// Each cursor holds a connection, so they MUST leave some connections free for other queries
+	if directory.MaxCursors < 1 || directory.MaxCursors >= directory.PoolMaxActive {
+		return errors.New("the maximum number of cursors MUST be at least 1, and less than the maximum number of active connections")
+	}
+
+	return nil
+}
+
+func newConnPool(directory directory, logger *logrus.Entry) *connPool {
+	p := &connPool{
+		directory: directory,
+		logger:    logger,
+		slots:     make(chan struct{}, directory.PoolMaxActive),
+		cursors:   make(map[string]*cursor),
+		rootDSEs:  make(map[string]cachedRootDSE),
+	}
+
+	p.fill()
+
+	go func() {
+		for range time.Tick(poolMaintenanceInterval) {
+			p.expireCursors()
+			p.prune()
+			p.fill()
+		}
+	}()
+
+	return p
+}
+
+// get borrows a connection from the pool, opening and binding a new one if there are no healthy idle connections available.
+// Every connection borrowed MUST be returned using put.
+func (p *connPool) get(ctx context.Context) (*pooledConn, error) {
+	start := time.Now()
+
+	timer := time.NewTimer(time.Duration(p.directory.PoolWaitTimeout))
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		poolErrors.WithLabelValues(p.directory.Name, "wait").Inc()
+		return nil, errors.New("timed out waiting for a free directory connection")
+	case <-ctx.Done():
+		poolErrors.WithLabelValues(p.directory.Name, "wait").Inc()
+		return nil, errors.Wrap(ctx.Err(), "gave up waiting for a free directory connection")
+	}
+
+	poolWaitDuration.WithLabelValues(p.directory.Name).Observe(time.Since(start).Seconds())
+	poolConnections.WithLabelValues(p.directory.Name, "in_use").Inc()
+
+	for {
+		conn := p.popIdle()
+		if conn == nil {
+			break
+		}
+
+		if p.healthy(conn) {
+			return conn, nil
+		}
+
+		conn.Close()
+	}
+
+	// Either the pool was empty, or the idle connections had been dropped by the server, so we need a fresh one
+	conn, err := p.open()
+	if err != nil {
+		poolConnections.WithLabelValues(p.directory.Name, "in_use").Dec()
+		<-p.slots
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// put returns a borrowed connection to the pool.
+// The error from the last operation on the connection is passed so that connections which have failed at the network level are discarded instead of being reused.
+func (p *connPool) put(conn *pooledConn, err error) {
+	defer func() {
+		poolConnections.WithLabelValues(p.directory.Name, "in_use").Dec()
+		<-p.slots
+	}()
+
+	if err != nil {
+		if ldapErr, ok := err.(*ldap.Error); !ok || ldapErr.ResultCode >= ldap.ErrorNetwork {
+			conn.Close()
+			return
+		}
+	}
+
+	if conn.IsClosing() || p.expired(conn) {
+		conn.Close()
+		return
+	}
+
+	conn.lastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= p.directory.PoolMaxIdle {
+		conn.Close()
+		return
+	}
+
+	p.idle = append(p.idle, conn)
+	poolConnections.WithLabelValues(p.directory.Name, "idle").Set(float64(len(p.idle)))
+}
+
+func (p *connPool) open() (*pooledConn, error) {
+	ldapConn, host, err := bindToDC(p.directory, p.logger)
+	if err != nil {
+		poolErrors.WithLabelValues(p.directory.Name, "bind").Inc()
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &pooledConn{
+		Conn:     ldapConn,
+		host:     host,
+		created:  now,
+		lastUsed: now,
+	}, nil
+}
+
+// popIdle takes the most recently used idle connection, as it is the least likely to have been dropped by the server
+func (p *connPool) popIdle() *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) == 0 {
+		return nil
+	}
+
+	conn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	poolConnections.WithLabelValues(p.directory.Name, "idle").Set(float64(len(p.idle)))
+
+	return conn
+}
+
+func (p *connPool) expired(conn *pooledConn) bool {
+	return p.directory.PoolMaxLifetime > 0 && time.Since(conn.created) > time.Duration(p.directory.PoolMaxLifetime)
+}
+
+// healthy checks that a connection taken from the idle list can still be used.
+// Connections which have been idle for a while are probed with a cheap search of the root DSE.
+func (p *connPool) healthy(conn *pooledConn) bool {
+	if conn.IsClosing() || p.expired(conn) {
+		return false
+	}
+
+	if time.Since(conn.lastUsed) < healthCheckAfterIdle {
+		return true
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+
+	_, err := conn.Search(searchRequest)
+	if err != nil {
+		poolErrors.WithLabelValues(p.directory.Name, "health_check").Inc()
+
+		p.logger.WithFields(logrus.Fields{
+			"function":  "healthy",
+			"directory": p.directory.Name,
+			"error":     err,
+		}).Debug("idle directory connection failed health check; discarding")
+
+		return false
+	}
+
+	return true
+}
+
+// prune closes idle connections which have exceeded their lifetime, or which the server has already closed
+func (p *connPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := p.idle[:0]
+	for _, conn := range p.idle {
+		if conn.IsClosing() || p.expired(conn) {
+			conn.Close()
+			continue
+		}
+
+		idle = append(idle, conn)
+	}
+
+	p.idle = idle
+	poolConnections.WithLabelValues(p.directory.Name, "idle").Set(float64(len(p.idle)))
+}
+
+// fill opens connections until the pool has the minimum number of idle connections
+func (p *connPool) fill() {
+	for {
+		p.mu.Lock()
+		idle := len(p.idle)
+		p.mu.Unlock()
+
+		if idle >= p.directory.PoolMinIdle {
+			return
+		}
+
+		conn, err := p.open()
+		if err != nil {
+			p.logger.WithFields(logrus.Fields{
+				"function":  "fill",
+				"directory": p.directory.Name,
+				"error":     err,
+			}).Error("unable to open idle directory connection")
+
+			return
+		}
+
+		p.mu.Lock()
+		p.idle = append(p.idle, conn)
+		poolConnections.WithLabelValues(p.directory.Name, "idle").Set(float64(len(p.idle)))
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+// csvWriter writes each entry as a row of CSV (RFC 4180), with the DN in the first column followed by the requested attributes in order.
+// Every value of each attribute is included, joined with the separator from the query.
+//
+// CSV has nowhere to put the outcome of the search, so it is sent in HTTP trailers instead; see finish.
+type csvWriter struct {
+	w         http.ResponseWriter
+	csv       *csv.Writer
+	query     Query
+	columns   []string
+	directory directory
+	header    bool
+	count     int
+	begun     bool
+}
+
+func newCSVWriter(w http.ResponseWriter, query Query, directory directory, header bool) *csvWriter {
+	// The DN is always the first column, so there's no need to repeat it if it has been asked for as an attribute
+	var columns []string
+	for _, a := range query.Attributes {
+		if strings.ToLower(a) != "distinguishedname" {
+			columns = append(columns, a)
+		}
+	}
+
+	// Every value is needed, not just the first
+	query.AllValues = true
+
+	c := &csvWriter{
+		w:         w,
+		csv:       csv.NewWriter(w),
+		query:     query,
+		columns:   columns,
+		directory: directory,
+		header:    header,
+	}
+	c.csv.UseCRLF = true
+
+	return c
+}
+
+// begin sends the HTTP status and the header row, the first time anything is written
+func (c *csvWriter) begin() {
+	if c.begun {
+		return
+	}
+	c.begun = true
+
+	headerParam := "absent"
+	if c.header {
+		headerParam = "present"
+	}
+
+	c.w.Header().Set("Content-Type", "text/csv; charset=UTF-8; header="+headerParam)
+	c.w.Header().Set("Trailer", resultTrailers)
+	c.w.WriteHeader(http.StatusOK)
+
+	if c.header {
+		c.csv.Write(append([]string{"dn"}, c.columns...))
+	}
+}
+
+func (c *csvWriter) started() bool {
+	return c.begun
+}
+
+func (c *csvWriter) writeEntries(entries []*ldap.Entry) error {
+	c.begin()
+
+	for _, entry := range entries {
+		object := newLDAPObject(entry, c.query, c.directory)
+
+		row := []string{entry.DN}
+		for _, a := range c.columns {
+			values, _ := object.Attributes[a].([]string)
+			row = append(row, strings.Join(values, c.query.CSVSeparator))
+		}
+
+		err := c.csv.Write(row)
+		if err != nil {
+			return err
+		}
+
+		c.count++
+	}
+
+	c.csv.Flush()
+	flush(c.w)
+
+	return c.csv.Error()
+}
+
+func (c *csvWriter) finish(summary streamSummary) error {
+	c.begin()
+
+	c.csv.Flush()
+
+	summary.Count = c.count
+	setResultTrailers(c.w, summary)
+
+	return c.csv.Error()
+}
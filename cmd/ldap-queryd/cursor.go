@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errCursorNotFound = errors.New("cursor does not exist or has expired")
+	errCursorMismatch = errors.New("cursor was created by a different query; the query MUST be the same for every page")
+	errCursorExpired  = errors.New("cursor expired")
+	errCursorEvicted  = errors.New("cursor dropped to make room for a newer cursor")
+)
+
+// cursor holds the state of a paged search between requests.
+// LDAP paging cookies are only valid on the connection the search was started on, so the connection is held by the cursor,
+// rather than being returned to the pool, until the last page has been read or the cursor expires.
+type cursor struct {
+	conn        *pooledConn
+	cookie      []byte
+	fingerprint string
+	returned    int
+	expires     time.Time
+}
+
+// queryFingerprint identifies the search a cursor belongs to, so that a cursor cannot be used to continue a different search
+func queryFingerprint(directoryName string, query Query) string {
+	b, _ := json.Marshal(struct {
+		Directory  string
+		Filter     string
+		Base       string
+		Scope      string
+		Attributes []string
+		SizeLimit  int
+		TimeLimit  int
+		PageSize   int
+		Sort       []sortKey
+	}{
+		directoryName,
+		query.Filter,
+		query.Base,
+		query.Scope,
+		query.Attributes,
+		query.SizeLimit,
+		query.TimeLimit,
+		query.PageSize,
+		query.Sort,
+	})
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// holdCursor keeps a connection with a paged search in progress, returning the ID which is handed to the consumer to fetch the next page.
+// returned is the number of entries returned so far, so that the size limit can be applied across pages.
+func (p *connPool) holdCursor(conn *pooledConn, cookie []byte, fingerprint string, returned int) (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to generate cursor ID")
+	}
+
+	var evicted []*cursor
+
+	p.mu.Lock()
+
+	// Abandoned paged searches would otherwise hold connections until they expire, leaving none for other queries.
+	// The cursor which has gone unused the longest is dropped to make room.
+	for len(p.cursors) >= p.directory.MaxCursors {
+		var oldest string
+		for cid, c := range p.cursors {
+			if oldest == "" || c.expires.Before(p.cursors[oldest].expires) {
+				oldest = cid
+			}
+		}
+
+		evicted = append(evicted, p.cursors[oldest])
+		delete(p.cursors, oldest)
+	}
+
+	p.cursors[id.String()] = &cursor{
+		conn:        conn,
+		cookie:      cookie,
+		fingerprint: fingerprint,
+		returned:    returned,
+		expires:     time.Now().Add(time.Duration(p.directory.CursorTimeout)),
+	}
+
+	poolCursors.WithLabelValues(p.directory.Name).Set(float64(len(p.cursors)))
+
+	p.mu.Unlock()
+
+	// The connections are closed, rather than reused, as they still have a paged search in progress
+	for _, c := range evicted {
+		p.put(c.conn, errCursorEvicted)
+	}
+
+	if len(evicted) > 0 {
+		p.logger.WithFields(logrus.Fields{
+			"function":  "holdCursor",
+			"directory": p.directory.Name,
+			"cursors":   len(evicted),
+		}).Warn("maximum number of cursors reached; dropped the least recently used cursor")
+	}
+
+	return id.String(), nil
+}
+
+// resumeCursor takes a cursor so that the next page of its search can be read.
+// The cursor is removed from the pool; the connection it holds MUST either be held again using holdCursor, or returned using put.
+func (p *connPool) resumeCursor(id string, fingerprint string) (*cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.cursors[id]
+	if !ok || time.Now().After(c.expires) {
+		return nil, errCursorNotFound
+	}
+
+	if c.fingerprint != fingerprint {
+		return nil, errCursorMismatch
+	}
+
+	delete(p.cursors, id)
+	poolCursors.WithLabelValues(p.directory.Name).Set(float64(len(p.cursors)))
+
+	return c, nil
+}
+
+// expireCursors releases the connections held by cursors which haven't been used within the cursor timeout.
+// The connections are closed, rather than reused, as they still have a paged search in progress.
+func (p *connPool) expireCursors() {
+	var expired []*cursor
+
+	p.mu.Lock()
+	for id, c := range p.cursors {
+		if time.Now().After(c.expires) {
+			expired = append(expired, c)
+			delete(p.cursors, id)
+		}
+	}
+	poolCursors.WithLabelValues(p.directory.Name).Set(float64(len(p.cursors)))
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		p.put(c.conn, errCursorExpired)
+	}
+
+	if len(expired) > 0 {
+		p.logger.WithFields(logrus.Fields{
+			"function":  "expireCursors",
+			"directory": p.directory.Name,
+			"cursors":   len(expired),
+		}).Debug("expired paged search cursors")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// directoryPools holds the connection pool for each directory being served, keyed by the name of the directory.
+// Requests which do not name a directory are sent to the default directory, which is the first one configured.
+type directoryPools struct {
+	pools       map[string]*connPool
+	defaultName string
+}
+
+func (d directoryPools) get(name string) (*connPool, bool) {
+	if name == "" {
+		name = d.defaultName
+	}
+
+	pool, ok := d.pools[name]
+
+	return pool, ok
+}
+
+// routeDirectory serves requests to /directories/{name}/{endpoint}, passing them on to the handler for the endpoint.
+// The name of the directory is stored in the request context for the handler to pick up.
+func routeDirectory(pools directoryPools, endpoints map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/directories/"), "/"), "/")
+
+		if len(parts) != 2 {
+			APIResponse := Response{
+				Message: "requests MUST be made to /directories/{name}/{endpoint}",
+			}
+
+			APIResponse.Send(http.StatusNotFound, w)
+
+			return
+		}
+
+		if _, ok := pools.pools[parts[0]]; !ok {
+			APIResponse := Response{
+				Message: fmt.Sprintf("directory '%s' does not exist", parts[0]),
+			}
+
+			APIResponse.Send(http.StatusNotFound, w)
+
+			return
+		}
+
+		handler, ok := endpoints[parts[1]]
+		if !ok {
+			APIResponse := Response{
+				Message: fmt.Sprintf("endpoint '%s' does not exist", parts[1]),
+			}
+
+			APIResponse.Send(http.StatusNotFound, w)
+
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), directoryCtxKey, parts[0])
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
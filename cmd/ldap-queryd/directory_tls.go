@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// The supported modes for securing the connection to the directory.
+// none = plain LDAP, which is the default
+// ldaps = TLS from the start of the connection, usually on port 636
+// starttls = plain LDAP connection which is upgraded to TLS using the StartTLS extended operation
+const (
+	tlsModeNone     = "none"
+	tlsModeLDAPS    = "ldaps"
+	tlsModeStartTLS = "starttls"
+)
+
+// newDirectoryTLSConfig validates the TLS settings for a directory and builds the TLS configuration used when connecting to it.
+// A nil config is returned if TLS has not been enabled.
+func newDirectoryTLSConfig(directory directory) (*tls.Config, error) {
+	switch directory.TLSMode {
+	case tlsModeNone:
+		if directory.TLSCACert != "" || directory.TLSServerName != "" || directory.TLSInsecureSkipVerify {
+			return nil, errors.New("TLS settings have been defined but the TLS mode is 'none'")
+		}
+
+		return nil, nil
+	case tlsModeLDAPS, tlsModeStartTLS:
+	default:
+		return nil, fmt.Errorf("TLS mode MUST be one of '%s', '%s', or '%s'", tlsModeNone, tlsModeLDAPS, tlsModeStartTLS)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         directory.TLSServerName,
+		InsecureSkipVerify: directory.TLSInsecureSkipVerify,
+	}
+
+	// If no CA bundle has been specified the system roots will be used to verify the directory certificate
+	if directory.TLSCACert != "" {
+		pem, err := os.ReadFile(directory.TLSCACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read TLS CA certificate bundle")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in %s", directory.TLSCACert)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// tlsConfigForHost returns the TLS configuration to use when connecting to a specific directory host.
+// Unless the server name has been overridden, the certificate presented by the host is verified against the host name we dialled.
+func (d directory) tlsConfigForHost(host string) *tls.Config {
+	tlsConfig := d.tlsConfig.Clone()
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	return tlsConfig
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// An attribute description is an attribute type, optionally followed by options such as ;binary or ;range=0-1499; see RFC 4512 section 2.5
+var validAttributeDescription = regexp.MustCompile(`^(?:[A-Za-z][A-Za-z0-9-]*|[0-9]+(?:\.[0-9]+)*)(?:;[A-Za-z0-9=-]+)*$`)
+
+// filterSyntaxError describes where a filter is invalid, and why.
+// Position is the 1-based index of the character at which the problem was found.
+type filterSyntaxError struct {
+	Position int
+	Reason   string
+}
+
+func (e *filterSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Position, e.Reason)
+}
+
+// validateFilter checks that a filter is valid according to RFC 4515, and can be compiled by the ldap package.
+//
+// ldap.CompileFilter does not say where a filter is invalid, so the filter is first checked by filterParser, which does.
+// The filter is then compiled anyway, in case there is anything the ldap package cannot handle.
+func validateFilter(filter string) error {
+	p := &filterParser{filter: filter}
+
+	err := p.parse()
+	if err != nil {
+		return err
+	}
+
+	_, err = ldap.CompileFilter(filter)
+	if err != nil {
+		if ldapErr, ok := err.(*ldap.Error); ok {
+			return errors.New(strings.TrimPrefix(ldapErr.Err.Error(), "ldap: "))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// normaliseFilter returns the filter as the ldap package will send it to the directory, or the filter unchanged if it cannot be compiled
+func normaliseFilter(filter string) string {
+	packet, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return filter
+	}
+
+	normalised, err := ldap.DecompileFilter(packet)
+	if err != nil {
+		return filter
+	}
+
+	return normalised
+}
+
+// filterParser is a recursive descent parser for the string representation of LDAP search filters defined in RFC 4515.
+// It does not build anything; it only checks that the filter is well formed.
+type filterParser struct {
+	filter string
+	pos    int
+}
+
+func (p *filterParser) parse() error {
+	if p.filter == "" {
+		return p.fail("filter is empty")
+	}
+
+	err := p.parseFilter()
+	if err != nil {
+		return err
+	}
+
+	if p.pos < len(p.filter) {
+		return p.fail("unexpected %q after the end of the filter; check the brackets are balanced", p.filter[p.pos])
+	}
+
+	return nil
+}
+
+func (p *filterParser) fail(reason string, args ...interface{}) error {
+	return &filterSyntaxError{
+		Position: p.pos + 1,
+		Reason:   fmt.Sprintf(reason, args...),
+	}
+}
+
+func (p *filterParser) atEnd() bool {
+	return p.pos >= len(p.filter)
+}
+
+func (p *filterParser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+
+	return p.filter[p.pos]
+}
+
+// filter = "(" filtercomp ")"
+func (p *filterParser) parseFilter() error {
+	if p.atEnd() {
+		return p.fail("unexpected end of filter; expected '('")
+	}
+
+	if p.peek() != '(' {
+		return p.fail("expected '(' but found %q", p.peek())
+	}
+	p.pos++
+
+	var err error
+
+	switch p.peek() {
+	case '&', '|':
+		p.pos++
+
+		// The absolute true and false filters, (&) and (|), from RFC 4526 are not accepted; they need at least one component
+		if p.peek() == ')' {
+			return p.fail("filter has no components; '%c' MUST be followed by at least one filter", p.filter[p.pos-1])
+		}
+
+		if p.peek() != '(' {
+			if p.atEnd() {
+				return p.fail("unexpected end of filter; expected '(' to start a component filter")
+			}
+
+			return p.fail("expected '(' to start a component filter but found %q", p.peek())
+		}
+
+		for p.peek() == '(' {
+			err = p.parseFilter()
+			if err != nil {
+				return err
+			}
+		}
+	case '!':
+		p.pos++
+		err = p.parseFilter()
+	default:
+		err = p.parseItem()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if p.atEnd() {
+		return p.fail("unexpected end of filter; expected ')'")
+	}
+
+	if p.peek() != ')' {
+		return p.fail("expected ')' but found %q", p.peek())
+	}
+	p.pos++
+
+	return nil
+}
+
+// item = simple / present / substring / extensible
+func (p *filterParser) parseItem() error {
+	if p.peek() == ':' {
+		return p.parseExtensible(false)
+	}
+
+	err := p.parseAttributeDescription()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case p.peek() == '=':
+		p.pos++
+		return p.parseValue(true)
+	case strings.HasPrefix(p.filter[p.pos:], "~="), strings.HasPrefix(p.filter[p.pos:], ">="), strings.HasPrefix(p.filter[p.pos:], "<="):
+		p.pos += 2
+		return p.parseValue(false)
+	case p.peek() == ':':
+		return p.parseExtensible(true)
+	case p.atEnd():
+		return p.fail("unexpected end of filter; expected '=', '~=', '>=', '<=' or ':='")
+	}
+
+	return p.fail("expected '=', '~=', '>=', '<=' or ':=' after the attribute description but found %q", p.peek())
+}
+
+func (p *filterParser) parseAttributeDescription() error {
+	start := p.pos
+
+	for !p.atEnd() && strings.IndexByte("=~<>:()", p.peek()) == -1 {
+		p.pos++
+	}
+
+	attribute := p.filter[start:p.pos]
+
+	if attribute == "" {
+		if p.atEnd() {
+			return p.fail("unexpected end of filter; expected an attribute description")
+		}
+
+		return p.fail("expected an attribute description but found %q", p.peek())
+	}
+
+	if !validAttributeDescription.MatchString(attribute) {
+		p.pos = start
+		return p.fail("%q is not a valid attribute description", attribute)
+	}
+
+	return nil
+}
+
+// extensible = ( attr [":dn"] [":" matchingrule] ":=" assertionvalue ) / ( [":dn"] ":" matchingrule ":=" assertionvalue )
+func (p *filterParser) parseExtensible(hasAttribute bool) error {
+	dn := false
+	rule := false
+
+	for {
+		if p.peek() != ':' {
+			if p.atEnd() {
+				return p.fail("unexpected end of filter; expected ':='")
+			}
+
+			return p.fail("expected ':=' but found %q", p.peek())
+		}
+		p.pos++
+
+		if p.peek() == '=' {
+			break
+		}
+
+		start := p.pos
+		for !p.atEnd() && strings.IndexByte(":=()", p.peek()) == -1 {
+			p.pos++
+		}
+		token := p.filter[start:p.pos]
+
+		switch {
+		case strings.EqualFold(token, "dn") && !dn && !rule:
+			dn = true
+		case !rule && validAttributeType.MatchString(token):
+			rule = true
+		default:
+			p.pos = start
+			return p.fail("%q is not a valid matching rule", token)
+		}
+	}
+
+	if !hasAttribute && !rule {
+		return p.fail("a matching rule is required when an extensible match does not include an attribute")
+	}
+
+	p.pos++
+
+	return p.parseValue(false)
+}
+
+// parseValue checks an assertion value, up to the closing bracket of the filter.
+// Wildcards are only allowed in equality and substring matches.
+func (p *filterParser) parseValue(allowWildcard bool) error {
+	for !p.atEnd() && p.peek() != ')' {
+		switch p.peek() {
+		case '(':
+			return p.fail("'(' in a value MUST be escaped as \\28")
+		case '*':
+			if !allowWildcard {
+				return p.fail("'*' is only allowed in '=' matches; a literal '*' MUST be escaped as \\2a")
+			}
+		case 0:
+			return p.fail("NUL in a value MUST be escaped as \\00")
+		case '\\':
+			if len(p.filter) < p.pos+3 || !isHexDigit(p.filter[p.pos+1]) || !isHexDigit(p.filter[p.pos+2]) {
+				return p.fail("'\\' MUST be followed by two hex digits; a literal '\\' MUST be escaped as \\5c")
+			}
+			p.pos += 2
+		}
+
+		p.pos++
+	}
+
+	return nil
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestValidateFilter(t *testing.T) {
+	valid := []string{
+		"(cn=user01)",
+		"(cn=*)",
+		"(cn=user*)",
+		"(cn=*ser*1)",
+		"(cn=)",
+		"(sn~=smith)",
+		"(uSNChanged>=1000)",
+		"(uSNChanged<=1000)",
+		`(cn=\28admins\29)`,
+		`(cn=a\2ab)`,
+		"(userCertificate;binary=*)",
+		"(2.5.4.3=user01)",
+		"(&(objectClass=user)(cn=user01))",
+		"(|(cn=a)(cn=b)(cn=c))",
+		"(!(cn=a))",
+		"(&(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=2)))",
+		"(member:1.2.840.113556.1.4.1941:=CN=Group A,DC=corp,DC=local)",
+		"(cn:dn:=Users)",
+		"(:dn:2.5.13.5:=Users)",
+		"(:2.5.13.5:=Users)",
+	}
+
+	for _, f := range valid {
+		t.Run(f, func(t *testing.T) {
+			if err := validateFilter(f); err != nil {
+				t.Errorf("expected filter to be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{"", "syntax error at position 1: filter is empty"},
+		{"cn=user01", "syntax error at position 1: expected '(' but found 'c'"},
+		{"(cn=user01", "syntax error at position 11: unexpected end of filter; expected ')'"},
+		{"(cn=user01))", "syntax error at position 12: unexpected ')' after the end of the filter; check the brackets are balanced"},
+		{"(&)", "syntax error at position 3: filter has no components; '&' MUST be followed by at least one filter"},
+		{"(|)", "syntax error at position 3: filter has no components; '|' MUST be followed by at least one filter"},
+		{"(!(&))", "syntax error at position 5: filter has no components; '&' MUST be followed by at least one filter"},
+		{"(&x)", "syntax error at position 3: expected '(' to start a component filter but found 'x'"},
+		{"(|cn=a)", "syntax error at position 3: expected '(' to start a component filter but found 'c'"},
+		{"(&", "syntax error at position 3: unexpected end of filter; expected '(' to start a component filter"},
+		{"(&(cn=a)x)", "syntax error at position 9: expected ')' but found 'x'"},
+		{"(!)", "syntax error at position 3: expected '(' but found ')'"},
+		{"(cn)", "syntax error at position 4: expected '=', '~=', '>=', '<=' or ':=' after the attribute description but found ')'"},
+		{"(=a)", "syntax error at position 2: expected an attribute description but found '='"},
+		{"(c_n=a)", `syntax error at position 2: "c_n" is not a valid attribute description`},
+		{"(cn=(a))", `syntax error at position 5: '(' in a value MUST be escaped as \28`},
+		{"(cn~=a*)", `syntax error at position 7: '*' is only allowed in '=' matches; a literal '*' MUST be escaped as \2a`},
+		{`(cn=a\2)`, `syntax error at position 6: '\' MUST be followed by two hex digits; a literal '\' MUST be escaped as \5c`},
+		{`(cn=a\zz)`, `syntax error at position 6: '\' MUST be followed by two hex digits; a literal '\' MUST be escaped as \5c`},
+		{`(cn=a\`, `syntax error at position 6: '\' MUST be followed by two hex digits; a literal '\' MUST be escaped as \5c`},
+		{"(cn=a\x00)", `syntax error at position 6: NUL in a value MUST be escaped as \00`},
+		{"(:=a)", "syntax error at position 3: a matching rule is required when an extensible match does not include an attribute"},
+		{"(cn:x y:=a)", `syntax error at position 5: "x y" is not a valid matching rule`},
+		{"(cn:dn:rule:extra:=a)", `syntax error at position 13: "extra" is not a valid matching rule`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			err := validateFilter(tt.filter)
+			if err == nil {
+				t.Fatalf("expected %q, but filter was accepted", tt.err)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("expected %q, got %q", tt.err, err.Error())
+			}
+		})
+	}
+}
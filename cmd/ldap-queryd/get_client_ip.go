@@ -5,35 +5,168 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/justinas/alice"
+	"github.com/sirupsen/logrus"
 )
 
-func getClientIP(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the client IP from the remote address of the request
-		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			APIResponse := Response{
-				Message: "unable to retrieve 'RemoteAddr' HTTP header",
-				Error:   err.Error(),
+// getClientIP stores the IP of the client in the request context.
+//
+// If the request has passed through a proxy, the RemoteAddr will actually be the IP of the proxy, and the proxy will usually
+// have added the IP it received the request from to the Forwarded or X-Forwarded-For header.
+// Anyone can send those headers though, so they are only used when the request comes from one of the trusted proxies.
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For and RFC 7239 for more info.
+func getClientIP(trustedProxies []*net.IPNet, logger *logrus.Entry) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Retrieve the client IP from the remote address of the request
+			clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				APIResponse := Response{
+					Message: "unable to retrieve 'RemoteAddr' HTTP header",
+					Error:   err.Error(),
+				}
+
+				APIResponse.Send(http.StatusInternalServerError, w)
+
+				return
+			}
+
+			hops := forwardedHops(r.Header)
+
+			if len(hops) > 0 {
+				if isTrustedProxy(trustedProxies, clientIP) {
+					clientIP = resolveClientIP(trustedProxies, hops)
+				} else {
+					logger.WithFields(logrus.Fields{
+						"client_ip": clientIP,
+						"function":  "getClientIP",
+						"forwarded": hops,
+					}).Debug("ignoring forwarded headers from a source which is not a trusted proxy")
+				}
 			}
 
-			APIResponse.Send(http.StatusInternalServerError, w)
+			ctx := context.WithValue(r.Context(), clientIPCtxKey, clientIP)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// resolveClientIP walks the chain of forwarded addresses from the right, as each proxy appends the address it received the request from.
+// The first address which is not a trusted proxy is the client; anything to the left of it could have been made up by the client.
+// An address which can't be parsed, such as `unknown` or an obfuscated identifier, is returned as it is so that the request is not allowed through.
+// If every address is a trusted proxy, the leftmost one is the client.
+func resolveClientIP(trustedProxies []*net.IPNet, hops []string) string {
+	for i := len(hops) - 1; i > 0; i-- {
+		if !isTrustedProxy(trustedProxies, hops[i]) {
+			return hops[i]
+		}
+	}
+
+	return hops[0]
+}
+
+// isTrustedProxy checks whether the address is one of the trusted proxies
+func isTrustedProxy(trustedProxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(strings.SplitN(address, "%", 2)[0])
+
+	return ip != nil && containsIP(trustedProxies, ip)
+}
+
+// forwardedHops returns the addresses which the request has been forwarded for, oldest first.
+// The Forwarded header is used if there is one, otherwise X-Forwarded-For; the two are never mixed as proxies may only add to one of them.
+// Headers which appear more than once are treated as a single list, in the order they appear.
+func forwardedHops(header http.Header) []string {
+	var hops []string
 
-			return
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range splitForwarded(strings.Join(forwarded, ","), ',') {
+			hops = append(hops, forwardedFor(element))
 		}
 
-		// If the request has passed through a proxy, the RemoteAddr may actually end up being the IP of the proxy.
-		// Depending on how the proxy is configured, the X-Forwarded-For header may have been inserted to show the REAL client IP.
-		// If it's there, we'll grab it and use it.
-		// X-Forwarded-For could be a comma separated list, so we'll split it and then select the first entry which is the real client IP.
-		// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For for more info.
-		if r.Header.Get("X-Forwarded-For") != "" {
-			xForwardedFor := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
-			clientIP = strings.TrimSpace(xForwardedFor[0])
+		return hops
+	}
+
+	for _, v := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, stripPort(strings.TrimSpace(hop)))
 		}
+	}
+
+	return hops
+}
+
+// forwardedFor returns the address from the for parameter of an element of the Forwarded header, e.g. for="[2001:db8::17]:4711";proto=https.
+// An element without a for parameter is treated as an unknown address.
+func forwardedFor(element string) string {
+	for _, pair := range splitForwarded(element, ';') {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "for") {
+			continue
+		}
+
+		value := strings.TrimSpace(kv[1])
+		if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+		}
+
+		return stripPort(value)
+	}
+
+	return "unknown"
+}
+
+// splitForwarded splits the Forwarded header on sep, ignoring any separators inside quoted strings
+func splitForwarded(s string, sep rune) []string {
+	var parts []string
+
+	quoted := false
+	escaped := false
+	start := 0
+
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// stripPort removes the port, and the brackets around an IPv6 address, from a forwarded address; e.g. [2001:db8::17]:4711 or 192.0.2.43:47011
+func stripPort(address string) string {
+	if strings.HasPrefix(address, "[") {
+		if end := strings.Index(address, "]"); end > 0 {
+			return address[1:end]
+		}
+
+		return address
+	}
+
+	// A bare IPv6 address has more than one colon, and no port
+	if strings.Count(address, ":") == 1 {
+		return address[:strings.Index(address, ":")]
+	}
+
+	return address
+}
+
+// clientName identifies the caller in logs and metrics; the name it authenticated as if it did, otherwise its IP
+func clientName(r *http.Request) string {
+	if name, ok := r.Context().Value(clientCtxKey).(string); ok && name != "" {
+		return name
+	}
 
-		ctx := context.WithValue(r.Context(), clientIPCtxKey, clientIP)
+	clientIP, _ := r.Context().Value(clientIPCtxKey).(string)
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	return clientIP
 }
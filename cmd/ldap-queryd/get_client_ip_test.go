@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testTrustedProxies(t *testing.T) []*net.IPNet {
+	t.Helper()
+
+	trustedProxies, err := parseSources([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8:cafe::/48"})
+	if err != nil {
+		t.Fatalf("unable to parse trusted proxies: %v", err)
+	}
+
+	return trustedProxies
+}
+
+func TestForwardedHops(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []string
+	}{
+		{"no headers", http.Header{}, nil},
+		{"X-Forwarded-For", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, []string{"203.0.113.7"}},
+		{"X-Forwarded-For list", http.Header{"X-Forwarded-For": {"203.0.113.7, 10.1.1.1,10.2.2.2"}}, []string{"203.0.113.7", "10.1.1.1", "10.2.2.2"}},
+		{"X-Forwarded-For more than once", http.Header{"X-Forwarded-For": {"203.0.113.7, 10.1.1.1", "10.2.2.2"}}, []string{"203.0.113.7", "10.1.1.1", "10.2.2.2"}},
+		{"X-Forwarded-For with ports", http.Header{"X-Forwarded-For": {"203.0.113.7:47011, [2001:db8::17]:4711"}}, []string{"203.0.113.7", "2001:db8::17"}},
+		{"X-Forwarded-For with bare IPv6", http.Header{"X-Forwarded-For": {"2001:db8::17"}}, []string{"2001:db8::17"}},
+		{"Forwarded", http.Header{"Forwarded": {"for=203.0.113.7"}}, []string{"203.0.113.7"}},
+		{"Forwarded list", http.Header{"Forwarded": {"for=203.0.113.7;proto=https, for=10.1.1.1"}}, []string{"203.0.113.7", "10.1.1.1"}},
+		{"Forwarded more than once", http.Header{"Forwarded": {"for=203.0.113.7", "for=10.1.1.1, for=10.2.2.2"}}, []string{"203.0.113.7", "10.1.1.1", "10.2.2.2"}},
+		{"Forwarded quoted IPv6 with port", http.Header{"Forwarded": {`for="[2001:db8::17]:4711"`}}, []string{"2001:db8::17"}},
+		{"Forwarded quoted IPv4 with port", http.Header{"Forwarded": {`for="203.0.113.7:47011"`}}, []string{"203.0.113.7"}},
+		{"Forwarded parameters in any order and case", http.Header{"Forwarded": {"proto=https;By=10.1.1.1;FOR=203.0.113.7"}}, []string{"203.0.113.7"}},
+		{"Forwarded without for", http.Header{"Forwarded": {"proto=https;by=10.1.1.1, for=10.2.2.2"}}, []string{"unknown", "10.2.2.2"}},
+		{"Forwarded unknown", http.Header{"Forwarded": {"for=unknown"}}, []string{"unknown"}},
+		{"Forwarded obfuscated identifier", http.Header{"Forwarded": {"for=_hidden"}}, []string{"_hidden"}},
+		{"Forwarded separators inside quotes", http.Header{"Forwarded": {`for=203.0.113.7;host="a,b;c", for=10.1.1.1`}}, []string{"203.0.113.7", "10.1.1.1"}},
+		{"Forwarded escaped quote inside quotes", http.Header{"Forwarded": {`for=203.0.113.7;host="a\",b", for=10.1.1.1`}}, []string{"203.0.113.7", "10.1.1.1"}},
+		{"Forwarded is used instead of X-Forwarded-For", http.Header{"Forwarded": {"for=203.0.113.7"}, "X-Forwarded-For": {"198.51.100.9"}}, []string{"203.0.113.7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedHops(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:47011", "203.0.113.7"},
+		{"2001:db8::17", "2001:db8::17"},
+		{"[2001:db8::17]", "2001:db8::17"},
+		{"[2001:db8::17]:4711", "2001:db8::17"},
+		{"[2001:db8::17", "[2001:db8::17"},
+		{"::1", "::1"},
+		{"unknown", "unknown"},
+		{"_hidden:_port", "_hidden"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if got := stripPort(tt.address); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trustedProxies := testTrustedProxies(t)
+
+	tests := []struct {
+		name string
+		hops []string
+		want string
+	}{
+		{"single hop", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"client behind trusted proxies", []string{"203.0.113.7", "10.1.1.1", "192.0.2.1"}, "203.0.113.7"},
+		{"spoofed address to the left of the client", []string{"10.9.9.9", "198.51.100.66", "203.0.113.7", "10.1.1.1"}, "203.0.113.7"},
+		{"spoofed trusted address to the left of the client", []string{"192.0.2.1", "203.0.113.7"}, "203.0.113.7"},
+		{"every hop is a trusted proxy", []string{"10.1.1.1", "10.2.2.2"}, "10.1.1.1"},
+		{"IPv6 client behind an IPv6 proxy", []string{"2001:db8::17", "2001:db8:cafe::1"}, "2001:db8::17"},
+		{"IPv6 zone", []string{"203.0.113.7", "2001:db8:cafe::1%eth0"}, "203.0.113.7"},
+		{"unknown hop stops the walk", []string{"203.0.113.7", "unknown", "10.1.1.1"}, "unknown"},
+		{"obfuscated hop stops the walk", []string{"203.0.113.7", "_hidden", "10.1.1.1"}, "_hidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveClientIP(trustedProxies, tt.hops); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	var got string
+	handler := getClientIP(testTrustedProxies(t), logrus.NewEntry(logger))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = r.Context().Value(clientIPCtxKey).(string)
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{"direct", "203.0.113.7:50000", http.Header{}, "203.0.113.7"},
+		{"direct IPv6", "[2001:db8::17]:50000", http.Header{}, "2001:db8::17"},
+		{"X-Forwarded-For from an untrusted source is ignored", "203.0.113.7:50000", http.Header{"X-Forwarded-For": {"10.1.1.1"}}, "203.0.113.7"},
+		{"Forwarded from an untrusted source is ignored", "203.0.113.7:50000", http.Header{"Forwarded": {"for=192.0.2.1"}}, "203.0.113.7"},
+		{"X-Forwarded-For from a trusted proxy", "10.1.1.1:50000", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"Forwarded from a trusted proxy", "192.0.2.1:50000", http.Header{"Forwarded": {`for="[2001:db8::17]:4711"`}}, "2001:db8::17"},
+		{"spoofed X-Forwarded-For through a trusted proxy", "10.1.1.1:50000", http.Header{"X-Forwarded-For": {"10.9.9.9, 203.0.113.7"}}, "203.0.113.7"},
+		{"trusted proxy without forwarded headers", "10.1.1.1:50000", http.Header{}, "10.1.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header = tt.header
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "not an address"
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d for an invalid RemoteAddr, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+// Tokens are only accepted if they are signed using one of these algorithms.
+// HMAC is deliberately not included, as the keys in a JWKS are public and anyone could sign a token with them.
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Allow for the clocks of the service and the token issuer being slightly out, when checking when a token expires or becomes valid
+const jwtLeeway = time.Minute
+
+// When a token is signed with a key which isn't in the JWKS, the JWKS is fetched again in case the keys have been rotated; but not more often than this
+const jwksRefreshInterval = time.Minute
+
+const jwksFetchTimeout = 10 * time.Second
+
+// errInsufficientScope is returned for tokens which are valid, but which don't have the scope needed to query
+var errInsufficientScope = errors.New("token does not have the required scope")
+
+// jwtVerifier checks bearer tokens issued by an OIDC provider, or anything else which signs JWTs and publishes its keys as a JWKS
+type jwtVerifier struct {
+	issuer        string
+	audience      string
+	requiredScope string
+
+	// jwks is the path or URL of the JWKS; only a URL is fetched again when an unknown key is seen
+	jwks string
+
+	parser *jwt.Parser
+
+	mu      sync.Mutex
+	keys    map[string]jsonWebKey
+	fetched time.Time
+}
+
+// jsonWebKey is a public key from a JWKS, along with the algorithm it is restricted to, if any
+type jsonWebKey struct {
+	alg string
+	key interface{}
+}
+
+// tokenClaims are the claims which are checked.
+// The scopes can be in either the scope claim, as a space separated string, or the scp claim, which some providers use for an array of scopes.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Scope scopeList `json:"scope"`
+	Scp   scopeList `json:"scp"`
+}
+
+// scopeList is a list of scopes, which can be written as either a space separated string or an array of strings
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	*s = strings.Fields(str)
+
+	return nil
+}
+
+// newJWTVerifier creates a verifier from the JWT settings, loading the JWKS so that any problem with it is found at startup.
+// A nil verifier is returned if JWT authentication is not configured.
+func newJWTVerifier(s server) (*jwtVerifier, error) {
+	if s.JWTIssuer == "" && s.JWTAudience == "" && s.JWTJWKS == "" && s.JWTRequiredScope == "" {
+		return nil, nil
+	}
+
+	if s.JWTIssuer == "" || s.JWTAudience == "" || s.JWTJWKS == "" {
+		return nil, errors.New("jwt_issuer, jwt_audience and jwt_jwks are all required to use JWT authentication")
+	}
+
+	v := &jwtVerifier{
+		issuer:        s.JWTIssuer,
+		audience:      s.JWTAudience,
+		requiredScope: s.JWTRequiredScope,
+		jwks:          s.JWTJWKS,
+		parser:        jwt.NewParser(jwt.WithValidMethods(jwtSigningMethods), jwt.WithoutClaimsValidation()),
+	}
+
+	err := v.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// verify checks the signature and claims of a token, returning its subject
+func (v *jwtVerifier) verify(token string) (string, error) {
+	claims := tokenClaims{}
+
+	_, err := v.parser.ParseWithClaims(token, &claims, v.keyFunc)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid token")
+	}
+
+	now := time.Now()
+
+	// The expiry is required, as a token without one would be valid forever
+	if claims.ExpiresAt == nil {
+		return "", errors.New("token does not have an expiry time")
+	}
+
+	if now.After(claims.ExpiresAt.Add(jwtLeeway)) {
+		return "", errors.New("token has expired")
+	}
+
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(claims.NotBefore.Time) {
+		return "", errors.New("token is not valid yet")
+	}
+
+	if !claims.VerifyIssuer(v.issuer, true) {
+		return "", fmt.Errorf("token was not issued by %s", v.issuer)
+	}
+
+	if !claims.VerifyAudience(v.audience, true) {
+		return "", fmt.Errorf("token is not for audience %s", v.audience)
+	}
+
+	if claims.Subject == "" {
+		return "", errors.New("token does not have a subject")
+	}
+
+	if v.requiredScope != "" && !hasScope(claims, v.requiredScope) {
+		return "", errInsufficientScope
+	}
+
+	return claims.Subject, nil
+}
+
+// hasScope checks whether the token has been granted the scope
+func hasScope(claims tokenClaims, scope string) bool {
+	for _, s := range append(claims.Scope, claims.Scp...) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keyFunc finds the key a token was signed with, using the kid in the token header.
+// A token without a kid can only be verified if the JWKS has a single key.
+func (v *jwtVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k, ok := v.key(kid)
+	if !ok && v.isURL() {
+		v.refreshKeys()
+		k, ok = v.key(kid)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("token is signed with unknown key %q", kid)
+	}
+
+	if k.alg != "" && k.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("key %q can not be used with %s", kid, token.Method.Alg())
+	}
+
+	return k.key, nil
+}
+
+func (v *jwtVerifier) key(kid string) (jsonWebKey, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+
+	k, ok := v.keys[kid]
+
+	return k, ok
+}
+
+func (v *jwtVerifier) isURL() bool {
+	return strings.HasPrefix(v.jwks, "https://") || strings.HasPrefix(v.jwks, "http://")
+}
+
+// refreshKeys fetches the JWKS again, in case the keys have been rotated.
+// If the JWKS can't be fetched the existing keys are kept, so that tokens signed with them are still accepted.
+func (v *jwtVerifier) refreshKeys() {
+	v.mu.Lock()
+	recent := time.Since(v.fetched) < jwksRefreshInterval
+	v.mu.Unlock()
+
+	if recent {
+		return
+	}
+
+	_ = v.loadKeys()
+}
+
+// loadKeys reads the JWKS from a file, or fetches it from a URL
+func (v *jwtVerifier) loadKeys() error {
+	var data []byte
+	var err error
+
+	if v.isURL() {
+		data, err = fetchJWKS(v.jwks)
+	} else {
+		data, err = os.ReadFile(v.jwks)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.fetched = time.Now()
+
+	if err != nil {
+		return errors.Wrapf(err, "unable to load JWKS from %s", v.jwks)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse JWKS from %s", v.jwks)
+	}
+
+	v.keys = keys
+
+	return nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := http.Client{Timeout: jwksFetchTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// parseJWKS parses the RSA and EC signing keys from a JWKS; see RFC 7517 and RFC 7518.
+// Keys of any other type, or which are only for encryption, are ignored.
+func parseJWKS(data []byte) (map[string]jsonWebKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]jsonWebKey)
+
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("keys[%d] is not a valid RSA key", i)
+			}
+
+			key = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			curves := map[string]elliptic.Curve{
+				"P-256": elliptic.P256(),
+				"P-384": elliptic.P384(),
+				"P-521": elliptic.P521(),
+			}
+
+			curve, ok := curves[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || errX != nil || errY != nil {
+				return nil, fmt.Errorf("keys[%d] is not a valid EC key", i)
+			}
+
+			pub := &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+
+			if !curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("keys[%d] is not a valid EC key", i)
+			}
+
+			key = pub
+		default:
+			continue
+		}
+
+		keys[k.Kid] = jsonWebKey{alg: k.Alg, key: key}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS does not contain any RSA or EC signing keys")
+	}
+
+	return keys, nil
+}
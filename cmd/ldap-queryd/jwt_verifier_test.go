@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "ldap-query"
+	testScope    = "ldap.query"
+)
+
+// testJWKS serves a JWKS holding whichever keys are currently published, counting how many times it is fetched
+type testJWKS struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func (j *testJWKS) publish(kid string, key *rsa.PrivateKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.keys[kid] = key
+}
+
+func (j *testJWKS) fetchCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.fetches
+}
+
+func (j *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.fetches++
+
+	type jwk struct {
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	for kid, key := range j.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Kid: kid,
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+
+	return key
+}
+
+// newTestVerifier starts a JWKS server publishing a single key, and creates a verifier which fetches its keys from it
+func newTestVerifier(t *testing.T) (*jwtVerifier, *testJWKS, *rsa.PrivateKey) {
+	t.Helper()
+
+	key := newTestKey(t)
+
+	jwks := &testJWKS{keys: map[string]*rsa.PrivateKey{"key1": key}}
+
+	ts := httptest.NewServer(jwks)
+	t.Cleanup(ts.Close)
+
+	v, err := newJWTVerifier(server{
+		JWTIssuer:        testIssuer,
+		JWTAudience:      testAudience,
+		JWTJWKS:          ts.URL,
+		JWTRequiredScope: testScope,
+	})
+	if err != nil {
+		t.Fatalf("unable to create verifier: %v", err)
+	}
+
+	return v, jwks, key
+}
+
+// validClaims returns claims which the test verifier accepts, for each test to change as needed
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+
+	return jwt.MapClaims{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "svc-reports",
+		"scope": "openid " + testScope,
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("unable to sign token: %v", err)
+	}
+
+	return s
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	v, _, key := newTestVerifier(t)
+
+	tests := []struct {
+		name   string
+		change func(jwt.MapClaims)
+		err    string
+	}{
+		{
+			name:   "valid",
+			change: func(c jwt.MapClaims) {},
+		},
+		{
+			name:   "scope as an array",
+			change: func(c jwt.MapClaims) { delete(c, "scope"); c["scp"] = []string{testScope} },
+		},
+		{
+			name:   "audience in a list",
+			change: func(c jwt.MapClaims) { c["aud"] = []string{"other", testAudience} },
+		},
+		{
+			name:   "expired",
+			change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * jwtLeeway).Unix() },
+			err:    "token has expired",
+		},
+		{
+			name:   "expired within leeway",
+			change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-jwtLeeway / 2).Unix() },
+		},
+		{
+			name:   "no expiry",
+			change: func(c jwt.MapClaims) { delete(c, "exp") },
+			err:    "token does not have an expiry time",
+		},
+		{
+			name:   "not valid yet",
+			change: func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(2 * jwtLeeway).Unix() },
+			err:    "token is not valid yet",
+		},
+		{
+			name:   "wrong issuer",
+			change: func(c jwt.MapClaims) { c["iss"] = "https://other.example.com" },
+			err:    "token was not issued by " + testIssuer,
+		},
+		{
+			name:   "wrong audience",
+			change: func(c jwt.MapClaims) { c["aud"] = "other" },
+			err:    "token is not for audience " + testAudience,
+		},
+		{
+			name:   "no subject",
+			change: func(c jwt.MapClaims) { delete(c, "sub") },
+			err:    "token does not have a subject",
+		},
+		{
+			name:   "missing scope",
+			change: func(c jwt.MapClaims) { c["scope"] = "openid profile" },
+			err:    errInsufficientScope.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.change(claims)
+
+			subject, err := v.verify(signToken(t, jwt.SigningMethodRS256, "key1", key, claims))
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected token to be accepted, got %v", err)
+				}
+
+				if subject != "svc-reports" {
+					t.Errorf("expected subject svc-reports, got %q", subject)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected %q, but token was accepted", tt.err)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("expected %q, got %q", tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestJWTVerifierSigningMethods(t *testing.T) {
+	v, _, key := newTestVerifier(t)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{
+			name:  "alg none",
+			token: signToken(t, jwt.SigningMethodNone, "key1", jwt.UnsafeAllowNoneSignatureType, validClaims()),
+		},
+		{
+			// Signed using the public key as the HMAC secret, as anyone who has fetched the JWKS could
+			name:  "HS256",
+			token: signToken(t, jwt.SigningMethodHS256, "key1", key.PublicKey.N.Bytes(), validClaims()),
+		},
+		{
+			name:  "signed with another key",
+			token: signToken(t, jwt.SigningMethodRS256, "key1", newTestKey(t), validClaims()),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.verify(tt.token)
+			if err == nil {
+				t.Fatal("expected token to be rejected")
+			}
+
+			if !strings.HasPrefix(err.Error(), "invalid token") {
+				t.Errorf("expected an invalid token error, got %q", err.Error())
+			}
+		})
+	}
+}
+
+func TestJWTVerifierUnknownKey(t *testing.T) {
+	v, jwks, _ := newTestVerifier(t)
+
+	rotated := newTestKey(t)
+	token := signToken(t, jwt.SigningMethodRS256, "key2", rotated, validClaims())
+
+	// The JWKS isn't fetched again within the refresh interval of the last fetch, however many unknown keys are seen
+	_, err := v.verify(token)
+	if err == nil || !strings.Contains(err.Error(), `unknown key "key2"`) {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+
+	if n := jwks.fetchCount(); n != 1 {
+		t.Fatalf("expected the JWKS to be fetched once, got %d", n)
+	}
+
+	// Once the interval has passed, an unknown key causes the JWKS to be fetched again and picks up the rotated key
+	jwks.publish("key2", rotated)
+
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksRefreshInterval)
+	v.mu.Unlock()
+
+	subject, err := v.verify(token)
+	if err != nil {
+		t.Fatalf("expected token signed with rotated key to be accepted, got %v", err)
+	}
+
+	if subject != "svc-reports" {
+		t.Errorf("expected subject svc-reports, got %q", subject)
+	}
+
+	if n := jwks.fetchCount(); n != 2 {
+		t.Errorf("expected the JWKS to be fetched twice, got %d", n)
+	}
+
+	// A key which is still unknown after the refresh is rejected
+	_, err = v.verify(signToken(t, jwt.SigningMethodRS256, "key3", newTestKey(t), validClaims()))
+	if err == nil || !strings.Contains(err.Error(), `unknown key "key3"`) {
+		t.Errorf("expected unknown key error, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+// ldapObject is the representation of a directory entry returned to the consumer.
+// Attribute values are either a string or, if all values have been requested, a slice of strings.
+type ldapObject struct {
+	DistinguishedName string                 `json:"distinguishedName,omitempty"`
+	Attributes        map[string]interface{} `json:"attributes,omitempty"`
+
+	// Path is the chain of group memberships which links the entry to the object a membership query was about; see membershipHit
+	Path []string `json:"path,omitempty"`
+}
+
+// newLDAPObject pulls the attributes requested by the consumer out of a directory entry.
+//
+// By default only the first value of each attribute is returned, as a string, with the exception of memberOf where all values are joined with a pipe.
+// If the query asks for all values, every attribute is returned as an array containing all of its values; attributes without any values are returned as an empty array.
+// Values of binary attributes are rendered as strings; see attributeValues.
+// If the query asks for values to be decoded, AD timestamps and enumerations are converted by decodeValues, and bitmask attributes are always returned as an array of flag names.
+func newLDAPObject(entry *ldap.Entry, query Query, directory directory) ldapObject {
+	object := ldapObject{
+		Attributes: make(map[string]interface{}),
+	}
+
+	for _, a := range query.Attributes {
+		if strings.ToLower(a) == "distinguishedname" {
+			object.DistinguishedName = entry.DN
+			continue
+		}
+
+		values := attributeValues(entry, a, directory)
+
+		if query.Decode {
+			if len(values) > 0 {
+				if flags, ok := decodeFlags(a, values[0]); ok {
+					object.Attributes[a] = flags
+					continue
+				}
+			}
+
+			values = decodeValues(a, values)
+		}
+
+		if query.AllValues {
+			if values == nil {
+				values = []string{}
+			}
+
+			object.Attributes[a] = values
+			continue
+		}
+
+		if strings.ToLower(a) == "memberof" {
+			object.Attributes[a] = strings.Join(values, "|")
+			continue
+		}
+
+		object.Attributes[a] = ""
+		if len(values) > 0 {
+			object.Attributes[a] = values[0]
+		}
+	}
+
+	return object
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+// LDIF lines longer than this are folded onto continuation lines, which start with a single space
+const ldifLineLength = 76
+
+// ldifWriter writes each entry as an LDIF (RFC 2849) record, with every value of each of the requested attributes.
+// Values are written exactly as they are stored in the directory; they are not decoded, and binary values are base64 encoded.
+//
+// The outcome of the search is sent in HTTP trailers, in the same way as for CSV.
+type ldifWriter struct {
+	w         http.ResponseWriter
+	buf       *bufio.Writer
+	query     Query
+	directory directory
+	count     int
+	begun     bool
+}
+
+func newLDIFWriter(w http.ResponseWriter, query Query, directory directory) *ldifWriter {
+	return &ldifWriter{
+		w:         w,
+		buf:       bufio.NewWriter(w),
+		query:     query,
+		directory: directory,
+	}
+}
+
+// begin sends the HTTP status and the version line, the first time anything is written
+func (l *ldifWriter) begin() {
+	if l.begun {
+		return
+	}
+	l.begun = true
+
+	l.w.Header().Set("Content-Type", "text/x-ldif; charset=UTF-8")
+	l.w.Header().Set("Trailer", resultTrailers)
+	l.w.WriteHeader(http.StatusOK)
+
+	l.buf.WriteString("version: 1\n")
+}
+
+func (l *ldifWriter) started() bool {
+	return l.begun
+}
+
+func (l *ldifWriter) writeEntries(entries []*ldap.Entry) error {
+	l.begin()
+
+	for _, entry := range entries {
+		l.buf.WriteString("\n")
+		l.writeLine("dn", []byte(entry.DN), false)
+
+		for _, a := range l.query.Attributes {
+			// The DN is already at the start of the record
+			if strings.ToLower(a) == "distinguishedname" {
+				continue
+			}
+
+			attr := findAttribute(entry, a)
+			if attr == nil {
+				continue
+			}
+
+			binary := l.directory.binaryFormat(a) != binaryFormatNone
+
+			for _, v := range attr.ByteValues {
+				l.writeLine(a, v, binary)
+			}
+		}
+
+		l.count++
+	}
+
+	err := l.buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	flush(l.w)
+
+	return nil
+}
+
+func (l *ldifWriter) finish(summary streamSummary) error {
+	l.begin()
+
+	summary.Count = l.count
+	setResultTrailers(l.w, summary)
+
+	return l.buf.Flush()
+}
+
+// writeLine writes an attribute value, base64 encoding it if it is binary or can't be written as it is, and folding it if it is too long
+func (l *ldifWriter) writeLine(attribute string, value []byte, binary bool) {
+	line := attribute + ": " + string(value)
+	if binary || !ldifSafeString(value) {
+		line = attribute + ":: " + base64.StdEncoding.EncodeToString(value)
+	}
+
+	// Only ASCII is written without being base64 encoded, so lines can be split anywhere.
+	// Continuation lines start with a space, which counts towards the line length.
+	limit := ldifLineLength
+	for len(line) > limit {
+		l.buf.WriteString(line[:limit])
+		l.buf.WriteString("\n ")
+
+		line = line[limit:]
+		limit = ldifLineLength - 1
+	}
+
+	l.buf.WriteString(line)
+	l.buf.WriteString("\n")
+}
+
+// ldifSafeString checks whether a value can be written as it is in LDIF, rather than base64 encoded.
+// A SAFE-STRING is ASCII without NUL, CR or LF, doesn't start with a space, ':' or '<', and, per RFC 2849, shouldn't end with a space.
+func ldifSafeString(value []byte) bool {
+	if len(value) == 0 {
+		return true
+	}
+
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+
+	for _, c := range value {
+		if c == 0 || c == '\n' || c == '\r' || c > 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
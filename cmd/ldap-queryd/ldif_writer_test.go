@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+func TestLDIFSafeString(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		safe  bool
+	}{
+		{"plain", "user01", true},
+		{"empty", "", true},
+		{"DN", "CN=user01,CN=Users,DC=corp,DC=local", true},
+		{"space in the middle", "Luke Skywalker", true},
+		{"colon in the middle", "a:b", true},
+		{"less than in the middle", "a<b", true},
+		{"leading space", " user01", false},
+		{"leading colon", ":user01", false},
+		{"leading less than", "<user01", false},
+		{"trailing space", "user01 ", false},
+		{"NUL", "a\x00b", false},
+		{"LF", "line1\nline2", false},
+		{"CR", "line1\rline2", false},
+		{"non-ASCII", "Ångström", false},
+		{"DEL is ASCII", "a\x7fb", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ldifSafeString([]byte(tt.value)); got != tt.safe {
+				t.Errorf("expected %v, got %v", tt.safe, got)
+			}
+		})
+	}
+}
+
+// writeLDIFLine writes a single attribute value, returning the lines written
+func writeLDIFLine(attribute string, value []byte, binary bool) []string {
+	var out bytes.Buffer
+
+	l := &ldifWriter{buf: bufio.NewWriter(&out)}
+	l.writeLine(attribute, value, binary)
+	l.buf.Flush()
+
+	return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+}
+
+// unfoldLDIF joins continuation lines back on to the line they continue
+func unfoldLDIF(lines []string) string {
+	var s strings.Builder
+
+	for i, line := range lines {
+		if i > 0 {
+			line = strings.TrimPrefix(line, " ")
+		}
+
+		s.WriteString(line)
+	}
+
+	return s.String()
+}
+
+func TestLDIFWriteLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		attribute string
+		value     []byte
+		binary    bool
+		want      string
+		lines     int
+	}{
+		{"short", "cn", []byte("user01"), false, "cn: user01", 1},
+		{"empty", "description", []byte{}, false, "description: ", 1},
+		{"unsafe is base64 encoded", "sn", []byte("Ångström"), false, "sn:: w4VuZ3N0csO2bQ==", 1},
+		{"leading space is base64 encoded", "cn", []byte(" x"), false, "cn:: IHg=", 1},
+		{"binary is base64 encoded", "objectGUID", testGUID, true, "objectGUID:: " + base64.StdEncoding.EncodeToString(testGUID), 1},
+		{"binary is base64 encoded even if safe", "userCertificate", []byte("abc"), true, "userCertificate:: YWJj", 1},
+		{"exactly the line length", "cn", []byte(strings.Repeat("a", 72)), false, "cn: " + strings.Repeat("a", 72), 1},
+		{"one over the line length", "cn", []byte(strings.Repeat("a", 73)), false, "cn: " + strings.Repeat("a", 73), 2},
+		{"exactly fills the first continuation line", "cn", []byte(strings.Repeat("a", 72+75)), false, "cn: " + strings.Repeat("a", 72+75), 2},
+		{"spills onto a second continuation line", "cn", []byte(strings.Repeat("a", 72+75+1)), false, "cn: " + strings.Repeat("a", 72+75+1), 3},
+		{"long base64 value", "thumbnailPhoto", bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 100), true, "thumbnailPhoto:: " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 100)), 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := writeLDIFLine(tt.attribute, tt.value, tt.binary)
+
+			if len(lines) != tt.lines {
+				t.Errorf("expected %d lines, got %d: %q", tt.lines, len(lines), lines)
+			}
+
+			for i, line := range lines {
+				if len(line) > ldifLineLength {
+					t.Errorf("line %d is %d characters long; the limit is %d", i+1, len(line), ldifLineLength)
+				}
+
+				if i > 0 && (!strings.HasPrefix(line, " ") || len(line) < 2) {
+					t.Errorf("continuation line %d %q MUST start with a single space and have something after it", i+1, line)
+				}
+			}
+
+			if got := unfoldLDIF(lines); got != tt.want {
+				t.Errorf("expected %q once unfolded, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLDIFWriter(t *testing.T) {
+	entries := []*ldap.Entry{
+		{
+			DN: "CN=user01,CN=Users,DC=corp,DC=local",
+			Attributes: []*ldap.EntryAttribute{
+				{Name: "cn", Values: []string{"user01"}, ByteValues: [][]byte{[]byte("user01")}},
+				{Name: "objectGUID", Values: []string{string(testGUID)}, ByteValues: [][]byte{testGUID}},
+				{Name: "memberOf", Values: []string{"CN=Group A,DC=corp,DC=local", "CN=Group B,DC=corp,DC=local"}, ByteValues: [][]byte{[]byte("CN=Group A,DC=corp,DC=local"), []byte("CN=Group B,DC=corp,DC=local")}},
+			},
+		},
+		{
+			DN: "CN=Ångström,CN=Users,DC=corp,DC=local",
+			Attributes: []*ldap.EntryAttribute{
+				{Name: "cn", Values: []string{"Ångström"}, ByteValues: [][]byte{[]byte("Ångström")}},
+			},
+		},
+	}
+
+	query := Query{Attributes: []string{"distinguishedName", "cn", "objectGUID", "memberOf", "mail"}}
+
+	w := httptest.NewRecorder()
+	l := newLDIFWriter(w, query, directory{})
+
+	if l.started() {
+		t.Fatal("expected nothing to have been sent before the first page")
+	}
+
+	err := l.writeEntries(entries)
+	if err != nil {
+		t.Fatalf("unable to write entries: %v", err)
+	}
+
+	err = l.finish(streamSummary{TraceID: "trace"})
+	if err != nil {
+		t.Fatalf("unable to finish: %v", err)
+	}
+
+	want := "version: 1\n" +
+		"\n" +
+		"dn: CN=user01,CN=Users,DC=corp,DC=local\n" +
+		"cn: user01\n" +
+		"objectGUID:: " + base64.StdEncoding.EncodeToString(testGUID) + "\n" +
+		"memberOf: CN=Group A,DC=corp,DC=local\n" +
+		"memberOf: CN=Group B,DC=corp,DC=local\n" +
+		"\n" +
+		"dn:: " + base64.StdEncoding.EncodeToString([]byte("CN=Ångström,CN=Users,DC=corp,DC=local")) + "\n" +
+		"cn:: " + base64.StdEncoding.EncodeToString([]byte("Ångström")) + "\n"
+
+	if got := w.Body.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/x-ldif; charset=UTF-8" {
+		t.Errorf("expected LDIF content type, got %q", ct)
+	}
+
+	if count := w.Header().Get("X-Result-Count"); count != "2" {
+		t.Errorf("expected a result count of 2, got %q", count)
+	}
+}
+
+func TestLDIFWriterWithNoEntries(t *testing.T) {
+	w := httptest.NewRecorder()
+	l := newLDIFWriter(w, Query{Attributes: []string{"cn"}}, directory{})
+
+	err := l.finish(streamSummary{TraceID: "trace"})
+	if err != nil {
+		t.Fatalf("unable to finish: %v", err)
+	}
+
+	if got := w.Body.String(); got != "version: 1\n" {
+		t.Errorf("expected only the version line, got %q", got)
+	}
+}
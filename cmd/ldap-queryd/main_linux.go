@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
@@ -16,24 +17,18 @@ import (
 type adQueryContextKeyType string
 
 const clientIPCtxKey adQueryContextKeyType = "client_ip"
+const clientCtxKey adQueryContextKeyType = "client"
 const traceIDCtxKey adQueryContextKeyType = "trace_id"
+const directoryCtxKey adQueryContextKeyType = "directory"
 
 var (
-	app           = "LDAP-Query"
-	version       string
-	build         string
-	directoryPort = 389
-
-	versionFlg            = flag.Bool("version", false, "Display application version")
-	portFlg               = flag.Int("port", 9999, "Port to listen for requests on")
-	debugFlg              = flag.Bool("debug", false, "Enable debug logging")
-	allowedSourcesFlg     = flag.String("allowed_sources", "", "IPs for sources that need to be able to make queries")
-	directoryHostsFlg     = flag.String("directory_hosts", "", "LDAP hosts to query")
-	directoryBindDnFlg    = flag.String("directory_bind_dn", "", "DN of account used to bind to the directory")
-	directoryBindPwdFlg   = flag.String("directory_bind_pw", "", "Password for account used to bind to the directory")
-	corsAllowedOriginsFlg = flag.String("cors-allowed-origins", "", "Allowed origins for CORS purposes")
-	corsAllowedHeadersFlg = flag.String("cors-allowed-headers", "*", "Allowed headers for CORS purposes")
-	helpFlg               = flag.Bool("help", false, "Display application help")
+	app     = "LDAP-Query"
+	version string
+	build   string
+
+	versionFlg = flag.Bool("version", false, "Display application version")
+	configFlg  = flag.String("config", "", "Path to a YAML, JSON or TOML config file")
+	helpFlg    = flag.Bool("help", false, "Display application help")
 )
 
 func main() {
@@ -59,69 +54,59 @@ func main() {
 		"build":   build,
 	})
 
-	missingFlags := false
-
-	if *allowedSourcesFlg == "" {
-		missingFlags = true
-		logger.WithFields(logrus.Fields{
-			"function": "run",
-		}).Error("The allowed_sources flag is required")
-	}
-
-	if *directoryHostsFlg == "" {
-		missingFlags = true
-		logger.WithFields(logrus.Fields{
-			"function": "run",
-		}).Error("The directory_hosts flag is required")
-	}
-
-	if *directoryBindDnFlg == "" {
-		missingFlags = true
+	config, err := loadConfig(*configFlg)
+	if err != nil {
 		logger.WithFields(logrus.Fields{
-			"function": "run",
-		}).Error("The directory_bind_dn flag is required")
+			"function": "main",
+			"error":    err,
+		}).Fatal("unable to load configuration")
 	}
 
-	if *directoryBindPwdFlg == "" {
-		missingFlags = true
+	errs := config.validate()
+	for _, err := range errs {
 		logger.WithFields(logrus.Fields{
-			"function": "run",
-		}).Error("The directory_bind_pw flag is required")
+			"function": "main",
+			"error":    err,
+		}).Error("invalid configuration")
 	}
 
-	if missingFlags {
+	if len(errs) > 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	config := parseConfig(
-		logger,
-		*allowedSourcesFlg,
-		*portFlg,
-		*debugFlg,
-		*directoryHostsFlg,
-		*directoryBindDnFlg,
-		*directoryBindPwdFlg,
-		directoryPort,
-		*corsAllowedOriginsFlg,
-		*corsAllowedHeadersFlg,
-	)
-
 	if config.Server.Debug {
-		logger.Level = logrus.DebugLevel
+		logger.Logger.Level = logrus.DebugLevel
 	} else {
-		logger.Level = logrus.InfoLevel
+		logger.Logger.Level = logrus.InfoLevel
 	}
 
-	// Need to ensure that we can bind to the directory before we bother listening for any requests.
-	ldapConn, err := bindToDC(config.Directory, logger)
-	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"function": "main",
-			"error":    err,
-		}).Fatal("unable to bind to directory")
+	pools := directoryPools{
+		pools:       make(map[string]*connPool),
+		defaultName: config.Directories[0].Name,
+	}
+
+	for _, directory := range config.Directories {
+		if directory.TLSInsecureSkipVerify {
+			logger.WithFields(logrus.Fields{
+				"function":  "main",
+				"directory": directory.Name,
+			}).Warn("directory certificate verification is disabled")
+		}
+
+		// Need to ensure that we can bind to the directory before we bother listening for any requests.
+		ldapConn, _, err := bindToDC(directory, logger)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"function":  "main",
+				"directory": directory.Name,
+				"error":     err,
+			}).Fatal("unable to bind to directory")
+		}
+		ldapConn.Close()
+
+		pools.pools[directory.Name] = newConnPool(directory, logger)
 	}
-	ldapConn.Close()
 
 	listeningPort := fmt.Sprintf(":%d", config.Server.Port)
 	server, err := net.Listen("tcp", listeningPort)
@@ -133,10 +118,27 @@ func main() {
 	}
 	defer server.Close()
 
+	// The listener only serves HTTPS if a certificate has been configured
+	if config.Server.tlsConfig != nil {
+		server = tls.NewListener(server, config.Server.tlsConfig)
+	}
+
 	middlewareChain := alice.New(
 		checkMethodIsPOST, // Ensure method is allowed
-		getClientIP,       // Store original client IP address in context
-		checkRequestSource(config.Server.AllowedSources, logger), // Ensure source IP is allowed to query
+		getClientIP(config.Server.trustedProxies, logger),                                        // Store original client IP address in context
+		checkRequestSource(config.Server.allowedNetworks, config.Server.deniedNetworks, logger),  // Ensure source IP is allowed to query
+		checkClientCertificate(config.Server.tlsConfig, config.Server.TLSClientSubjects, logger), // Identify caller from client certificate, if client certificates are required
+		authenticate(config.Server.APIKeys, config.Server.jwtVerifier, logger),                   // Ensure caller has authenticated, if API keys or JWTs are configured
+		traceID(logger), // Generate Trace ID and store in context
+	)
+
+	// Endpoints which describe the directory, rather than querying it, are requested using GET but are otherwise protected in the same way
+	getMiddlewareChain := alice.New(
+		checkMethodIsGET, // Ensure method is allowed
+		getClientIP(config.Server.trustedProxies, logger),                                        // Store original client IP address in context
+		checkRequestSource(config.Server.allowedNetworks, config.Server.deniedNetworks, logger),  // Ensure source IP is allowed to query
+		checkClientCertificate(config.Server.tlsConfig, config.Server.TLSClientSubjects, logger), // Identify caller from client certificate, if client certificates are required
+		authenticate(config.Server.APIKeys, config.Server.jwtVerifier, logger),                   // Ensure caller has authenticated, if API keys or JWTs are configured
 		traceID(logger), // Generate Trace ID and store in context
 	)
 
@@ -144,7 +146,15 @@ func main() {
 	mux := http.NewServeMux()
 
 	mux.Handle("/status", status())
-	mux.Handle("/", middlewareChain.ThenFunc(search(config.Directory, logger)))
+	mux.Handle("/", middlewareChain.ThenFunc(search(pools, logger)))
+	mux.Handle("/directories/", routeDirectory(pools, map[string]http.Handler{
+		"search":           middlewareChain.ThenFunc(search(pools, logger)),
+		membershipMembers:  middlewareChain.ThenFunc(membership(pools, membershipMembers, logger)),
+		membershipGroups:   middlewareChain.ThenFunc(membership(pools, membershipGroups, logger)),
+		membershipIsMember: middlewareChain.ThenFunc(membership(pools, membershipIsMember, logger)),
+		"rootdse":          getMiddlewareChain.ThenFunc(describeDirectory(pools, logger)),
+		"schema":           getMiddlewareChain.ThenFunc(describeSchema(pools, logger)),
+	}))
 	mux.Handle("/metrics", promhttp.Handler())
 
 	var handler http.Handler
@@ -163,7 +173,10 @@ func main() {
 		handler = http.Handler(mux)
 	}
 
-	logger.WithField("port", listeningPort).Debug("API server listening")
+	logger.WithFields(logrus.Fields{
+		"port": listeningPort,
+		"tls":  config.Server.tlsConfig != nil,
+	}).Debug("API server listening")
 
 	err = http.Serve(server, handler)
 	if err != nil {
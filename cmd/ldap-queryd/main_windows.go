@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
@@ -19,26 +20,20 @@ import (
 type adQueryContextKeyType string
 
 const clientIPCtxKey adQueryContextKeyType = "client_ip"
+const clientCtxKey adQueryContextKeyType = "client"
 const traceIDCtxKey adQueryContextKeyType = "trace_id"
+const directoryCtxKey adQueryContextKeyType = "directory"
 
 var (
-	app           = "LDAP-Query"
-	version       string
-	build         string
-	serviceDesc   = "REST API gateway for running queries against LDAP directory"
-	directoryPort = 389
-
-	versionFlg            = flag.Bool("version", false, "Display application version")
-	winServiceCommand     = flag.String("service", "", "Manage Windows services: install, uninstall, start, stop")
-	portFlg               = flag.Int("port", 9999, "Port to listen for requests on")
-	debugFlg              = flag.Bool("debug", false, "Enable debug logging")
-	allowedSourcesFlg     = flag.String("allowed_sources", "", "IPs for sources that need to be able to make queries")
-	directoryHostsFlg     = flag.String("directory_hosts", "", "LDAP hosts to query")
-	directoryBindDnFlg    = flag.String("directory_bind_dn", "", "DN of account used to bind to the directory")
-	directoryBindPwdFlg   = flag.String("directory_bind_pw", "", "Password for account used to bind to the directory")
-	corsAllowedOriginsFlg = flag.String("cors-allowed-origins", "", "Allowed origins for CORS purposes")
-	corsAllowedHeadersFlg = flag.String("cors-allowed-headers", "*", "Allowed headers for CORS purposes")
-	helpFlg               = flag.Bool("help", false, "Display application help")
+	app         = "LDAP-Query"
+	version     string
+	build       string
+	serviceDesc = "REST API gateway for running queries against LDAP directory"
+
+	versionFlg        = flag.Bool("version", false, "Display application version")
+	winServiceCommand = flag.String("service", "", "Manage Windows services: install, uninstall, start, stop")
+	configFlg         = flag.String("config", "", "Path to a YAML, JSON or TOML config file")
+	helpFlg           = flag.Bool("help", false, "Display application help")
 )
 
 type program struct {
@@ -163,69 +158,59 @@ func (p *program) run(svc service.Service) {
 		os.Exit(0)
 	}
 
-	missingFlags := false
-
-	if *allowedSourcesFlg == "" {
-		missingFlags = true
-		p.logger.WithFields(logrus.Fields{
-			"function": "run",
-		}).Error("The allowed_sources flag is required")
-	}
-
-	if *directoryHostsFlg == "" {
-		missingFlags = true
-		p.logger.WithFields(logrus.Fields{
-			"function": "run",
-		}).Error("The directory_hosts flag is required")
-	}
-
-	if *directoryBindDnFlg == "" {
-		missingFlags = true
+	config, err := loadConfig(*configFlg)
+	if err != nil {
 		p.logger.WithFields(logrus.Fields{
 			"function": "run",
-		}).Error("The directory_bind_dn flag is required")
+			"error":    err,
+		}).Fatal("unable to load configuration")
 	}
 
-	if *directoryBindPwdFlg == "" {
-		missingFlags = true
+	errs := config.validate()
+	for _, err := range errs {
 		p.logger.WithFields(logrus.Fields{
 			"function": "run",
-		}).Error("The directory_bind_pw flag is required")
+			"error":    err,
+		}).Error("invalid configuration")
 	}
 
-	if missingFlags {
+	if len(errs) > 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	config := parseConfig(
-		p.logger,
-		*allowedSourcesFlg,
-		*portFlg,
-		*debugFlg,
-		*directoryHostsFlg,
-		*directoryBindDnFlg,
-		*directoryBindPwdFlg,
-		directoryPort,
-		*corsAllowedOriginsFlg,
-		*corsAllowedHeadersFlg,
-	)
-
 	if config.Server.Debug {
 		p.logger.Logger.Level = logrus.DebugLevel
 	} else {
 		p.logger.Logger.Level = logrus.InfoLevel
 	}
 
-	// Need to ensure that we can bind to the directory before we bother listening for any requests.
-	ldapConn, err := bindToDC(config.Directory, p.logger)
-	if err != nil {
-		p.logger.WithFields(logrus.Fields{
-			"function": "run",
-			"error":    err,
-		}).Fatal("unable to bind to directory")
+	pools := directoryPools{
+		pools:       make(map[string]*connPool),
+		defaultName: config.Directories[0].Name,
+	}
+
+	for _, directory := range config.Directories {
+		if directory.TLSInsecureSkipVerify {
+			p.logger.WithFields(logrus.Fields{
+				"function":  "run",
+				"directory": directory.Name,
+			}).Warn("directory certificate verification is disabled")
+		}
+
+		// Need to ensure that we can bind to the directory before we bother listening for any requests.
+		ldapConn, _, err := bindToDC(directory, p.logger)
+		if err != nil {
+			p.logger.WithFields(logrus.Fields{
+				"function":  "run",
+				"directory": directory.Name,
+				"error":     err,
+			}).Fatal("unable to bind to directory")
+		}
+		ldapConn.Close()
+
+		pools.pools[directory.Name] = newConnPool(directory, p.logger)
 	}
-	ldapConn.Close()
 
 	listeningPort := fmt.Sprintf(":%d", config.Server.Port)
 	server, err := net.Listen("tcp", listeningPort)
@@ -237,10 +222,27 @@ func (p *program) run(svc service.Service) {
 	}
 	defer server.Close()
 
+	// The listener only serves HTTPS if a certificate has been configured
+	if config.Server.tlsConfig != nil {
+		server = tls.NewListener(server, config.Server.tlsConfig)
+	}
+
 	middlewareChain := alice.New(
 		checkMethodIsPOST, // Ensure method is allowed
-		getClientIP,       // Store original client IP address in context
-		checkRequestSource(config.Server.AllowedSources, p.logger), // Ensure source IP is allowed to query
+		getClientIP(config.Server.trustedProxies, p.logger),                                        // Store original client IP address in context
+		checkRequestSource(config.Server.allowedNetworks, config.Server.deniedNetworks, p.logger),  // Ensure source IP is allowed to query
+		checkClientCertificate(config.Server.tlsConfig, config.Server.TLSClientSubjects, p.logger), // Identify caller from client certificate, if client certificates are required
+		authenticate(config.Server.APIKeys, config.Server.jwtVerifier, p.logger),                   // Ensure caller has authenticated, if API keys or JWTs are configured
+		traceID(p.logger), // Generate Trace ID and store in context
+	)
+
+	// Endpoints which describe the directory, rather than querying it, are requested using GET but are otherwise protected in the same way
+	getMiddlewareChain := alice.New(
+		checkMethodIsGET, // Ensure method is allowed
+		getClientIP(config.Server.trustedProxies, p.logger),                                        // Store original client IP address in context
+		checkRequestSource(config.Server.allowedNetworks, config.Server.deniedNetworks, p.logger),  // Ensure source IP is allowed to query
+		checkClientCertificate(config.Server.tlsConfig, config.Server.TLSClientSubjects, p.logger), // Identify caller from client certificate, if client certificates are required
+		authenticate(config.Server.APIKeys, config.Server.jwtVerifier, p.logger),                   // Ensure caller has authenticated, if API keys or JWTs are configured
 		traceID(p.logger), // Generate Trace ID and store in context
 	)
 
@@ -248,7 +250,15 @@ func (p *program) run(svc service.Service) {
 	mux := http.NewServeMux()
 
 	mux.Handle("/status", status())
-	mux.Handle("/", middlewareChain.ThenFunc(search(config.Directory, p.logger)))
+	mux.Handle("/", middlewareChain.ThenFunc(search(pools, p.logger)))
+	mux.Handle("/directories/", routeDirectory(pools, map[string]http.Handler{
+		"search":           middlewareChain.ThenFunc(search(pools, p.logger)),
+		membershipMembers:  middlewareChain.ThenFunc(membership(pools, membershipMembers, p.logger)),
+		membershipGroups:   middlewareChain.ThenFunc(membership(pools, membershipGroups, p.logger)),
+		membershipIsMember: middlewareChain.ThenFunc(membership(pools, membershipIsMember, p.logger)),
+		"rootdse":          getMiddlewareChain.ThenFunc(describeDirectory(pools, p.logger)),
+		"schema":           getMiddlewareChain.ThenFunc(describeSchema(pools, p.logger)),
+	}))
 	mux.Handle("/metrics", promhttp.Handler())
 
 	var handler http.Handler
@@ -270,6 +280,7 @@ func (p *program) run(svc service.Service) {
 	p.logger.WithFields(logrus.Fields{
 		"function": "run",
 		"port":     listeningPort,
+		"tls":      config.Server.tlsConfig != nil,
 	}).Debug("API server listening")
 
 	err = http.Serve(server, handler)
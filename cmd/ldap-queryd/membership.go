@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// The membership endpoints, served at /directories/{name}/{endpoint}
+const (
+	membershipMembers  = "members"
+	membershipGroups   = "groups"
+	membershipIsMember = "ismember"
+)
+
+// MembershipQuery contains the possible parameters that can be passed in the request body of the membership endpoints
+// Group = DN of the group; REQUIRED for members and ismember
+// Member = DN of the user, group or other object; REQUIRED for groups and ismember
+// Base = only objects under this base are returned
+// Attributes = array of strings with the attributes to return for each object found, along with its DN and membership path
+// AllValues = return every attribute as an array of all of its values, rather than just the first value
+// Decode = convert AD timestamps and flag attributes, as for a search
+// MaxDepth = how many levels of nested groups to follow; defaults to the maximum of 32
+type MembershipQuery struct {
+	// REQUIRED parameter(s)
+	Group  string `json:"group"`
+	Member string `json:"member"`
+	Base   string `json:"base"`
+
+	// OPTIONAL parameter(s)
+	Attributes []string `json:"attributes"`
+	AllValues  bool     `json:"allValues"`
+	Decode     bool     `json:"decode"`
+	MaxDepth   int      `json:"maxDepth"`
+}
+
+// Validate ensures that the query passed is valid for the endpoint
+func (q *MembershipQuery) Validate(endpoint string) ([]ValidationError, error) {
+	var ve []ValidationError
+
+	// REQUIRED parameter validation
+	dns := []struct {
+		parameter string
+		value     string
+		required  bool
+	}{
+		{"group", q.Group, endpoint != membershipGroups},
+		{"member", q.Member, endpoint != membershipMembers},
+		{"base", q.Base, true},
+	}
+
+	for _, dn := range dns {
+		if dn.value == "" {
+			if dn.required {
+				ve = append(ve, ValidationError{
+					Parameter: dn.parameter,
+					Error:     "REQUIRED field",
+				})
+			}
+
+			continue
+		}
+
+		_, err := parseDN(dn.value)
+		if err != nil {
+			ve = append(ve, ValidationError{
+				Parameter: dn.parameter,
+				Error:     fmt.Sprintf("%s is not a valid DN: %s", dn.parameter, err),
+			})
+		}
+	}
+
+	// OPTIONAL parameter validation
+	for _, a := range q.Attributes {
+		if !validAttributeDescription.MatchString(a) {
+			ve = append(ve, ValidationError{
+				Parameter: "attributes",
+				Error:     fmt.Sprintf("%q is not a valid attribute name", a),
+			})
+		}
+	}
+
+	if q.MaxDepth < 1 || q.MaxDepth > maxMembershipDepth {
+		ve = append(ve, ValidationError{
+			Parameter: "maxDepth",
+			Error:     fmt.Sprintf("If specified, maxDepth MUST be between 1 and %d", maxMembershipDepth),
+		})
+	}
+
+	if len(ve) > 0 {
+		return ve, errors.New("validation failed")
+	}
+
+	return ve, nil
+}
+
+// UnmarshalJSON implements a custom unmarshaller for the query JSON payload to set default values if parameters have not been included.
+func (q *MembershipQuery) UnmarshalJSON(data []byte) error {
+	// Set default values before unmarshaling
+	q.MaxDepth = maxMembershipDepth
+
+	// Creating an Alias type prevents an endless loop
+	type Alias MembershipQuery
+	tmp := (*Alias)(q)
+
+	return json.Unmarshal(data, tmp)
+}
+
+// membership resolves nested group memberships for one of the membership endpoints.
+// members returns every member of a group, groups returns every group an object is a member of, and ismember checks
+// whether an object is a member of a group; in each case directly or through nested groups, with the path of group memberships which links them.
+func membership(pools directoryPools, endpoint string, logger *logrus.Entry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The traceID is included in every log entry, and in HTTP responses, to allow for correlation of logs
+		traceID := r.Context().Value(traceIDCtxKey).(string)
+
+		APIResponse := Response{
+			TraceID: traceID,
+		}
+
+		// The clientIP is included in every log entry for later analysis
+		clientIP := r.Context().Value(clientIPCtxKey).(string)
+
+		// The client is the name the caller authenticated as, or the clientIP if it did not; it is included in every log entry and in some metrics
+		client := clientName(r)
+
+		// The membership endpoints are only served under /directories/{name}, so the directory always comes from the URL
+		directoryName, _ := r.Context().Value(directoryCtxKey).(string)
+		pool, _ := pools.get(directoryName)
+
+		start := time.Now()
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "decode", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "membership",
+				"error":     err,
+			}).Error("unable to read HTTP request body")
+
+			APIResponse.Message = "unable to read HTTP request body"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		query := MembershipQuery{}
+		err = json.Unmarshal(body, &query)
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "parse", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "membership",
+				"error":     err,
+				"query":     body,
+			}).Error("unable to decode JSON query payload")
+
+			APIResponse.Message = "unable to decode JSON query payload"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		ve, err := query.Validate(endpoint)
+
+		base, baseErr := parseDN(query.Base)
+		if baseErr == nil && !pool.directory.withinNamingContexts(base) {
+			ve = append(ve, ValidationError{
+				Parameter: "base",
+				Error:     fmt.Sprintf("base MUST be within one of the naming contexts of directory '%s': %s", directoryName, strings.Join(pool.directory.NamingContexts, "; ")),
+			})
+			err = errors.New("validation failed")
+		}
+
+		if err != nil {
+			json, err := json.Marshal(ve)
+			if err != nil {
+				queryError.WithLabelValues(directoryName, "validate", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+				logger.WithFields(logrus.Fields{
+					"trace_id":  traceID,
+					"client_ip": clientIP,
+					"client":    client,
+					"directory": directoryName,
+					"function":  "membership",
+					"error":     err,
+				}).Error("unable to encode errors from validation process")
+
+				APIResponse.Message = "unable to encode errors from validation process"
+				APIResponse.Error = err.Error()
+				APIResponse.Send(http.StatusInternalServerError, w)
+
+				return
+			}
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":          traceID,
+				"client_ip":         clientIP,
+				"client":            client,
+				"directory":         directoryName,
+				"function":          "membership",
+				"validation errors": json,
+			}).Error("error(s) when validating incoming query")
+
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(json)
+
+			queryError.WithLabelValues(directoryName, "validate", strconv.Itoa(http.StatusBadRequest), client).Inc()
+
+			return
+		}
+
+		ldapConn, err := pool.get(r.Context())
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "bind", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "membership",
+				"error":     err,
+			}).Error("unable to bind to directory")
+
+			APIResponse.Message = "unable to bind to directory"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		// AD can resolve nested memberships itself; anything else has its groups walked by the service
+		dse, err := pool.rootDSE(ldapConn)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "membership",
+				"error":     err,
+			}).Warn("unable to check whether directory is AD; walking groups in the service")
+		}
+
+		inChain := err == nil && dse.isActiveDirectory()
+
+		logger.WithFields(logrus.Fields{
+			"trace_id":  traceID,
+			"client_ip": clientIP,
+			"client":    client,
+			"directory": directoryName,
+			"function":  "membership",
+			"endpoint":  endpoint,
+			"group":     query.Group,
+			"member":    query.Member,
+			"in_chain":  inChain,
+		}).Debug("Resolve group membership")
+
+		resolver := newMembershipResolver(ldapConn, query.Base, query.Attributes, query.MaxDepth, inChain)
+
+		var hits []membershipHit
+		if endpoint == membershipMembers {
+			hits, err = resolver.members(query.Group)
+		} else {
+			hits, err = resolver.groups(query.Member)
+		}
+
+		pool.put(ldapConn, errors.Cause(err))
+
+		if err != nil {
+			err2 := err
+			// Let's ensure we return a friendly error message if available
+			if ldapErr, ok := errors.Cause(err).(*ldap.Error); ok {
+				err2 = errors.New(ldap.LDAPResultCodeMap[ldapErr.ResultCode])
+			}
+
+			queryError.WithLabelValues(directoryName, "membership", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "membership",
+				"error":     err,
+				"group":     query.Group,
+				"member":    query.Member,
+				"base":      query.Base,
+			}).Error("unable to resolve group membership")
+
+			APIResponse.Message = "unable to resolve group membership"
+			APIResponse.Error = err2.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		if resolver.truncated {
+			APIResponse.Truncated = true
+			APIResponse.Message = "the maximum depth or number of objects was reached before all memberships were resolved"
+		}
+
+		// The attributes of each object are returned in the same way as for a search
+		search := Query{
+			Attributes: query.Attributes,
+			AllValues:  query.AllValues,
+			Decode:     query.Decode,
+		}
+
+		var objects []ldapObject
+		for _, h := range hits {
+			if endpoint == membershipIsMember && dnKey(h.entry.DN) != dnKey(query.Group) {
+				continue
+			}
+
+			object := newLDAPObject(h.entry, search, pool.directory)
+			object.DistinguishedName = h.entry.DN
+			object.Path = h.path
+
+			objects = append(objects, object)
+		}
+
+		duration := time.Since(start)
+		requestDuration.WithLabelValues(directoryName, strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
+
+		if endpoint == membershipIsMember {
+			isMember := len(objects) > 0
+			APIResponse.IsMember = &isMember
+			APIResponse.Result = objects
+			APIResponse.Send(http.StatusOK, w)
+
+			return
+		}
+
+		if len(objects) == 0 {
+			APIResponse.Send(http.StatusNotFound, w)
+			return
+		}
+
+		APIResponse.Result = objects
+		APIResponse.Send(http.StatusOK, w)
+	})
+}
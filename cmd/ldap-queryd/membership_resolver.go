@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// LDAP_MATCHING_RULE_IN_CHAIN, which AD uses to follow group memberships transitively; see MS-ADTS
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// The furthest a membership query follows nested groups; this is also the default
+const maxMembershipDepth = 32
+
+// The most objects a membership query returns, so that a query against a huge group can't search the directory indefinitely
+const maxMembershipObjects = 10000
+
+// membershipHit is an object found by a membership query.
+// The path starts with the object the query was about and ends with the object found, with any groups linking the two in between.
+type membershipHit struct {
+	entry *ldap.Entry
+	path  []string
+}
+
+// membershipResolver finds transitive group memberships under a search base.
+//
+// On AD the directory does the work using the in chain matching rule, and the membership paths are pieced together from memberOf.
+// On other directories the groups are walked one level at a time, following member.
+// Either way, objects are only visited once, so cycles in group memberships are harmless.
+type membershipResolver struct {
+	conn       *pooledConn
+	base       string
+	attributes []string
+	maxDepth   int
+	inChain    bool
+
+	// entries which have already been read while walking the groups, and how many objects have been read from the directory to find them
+	cache map[string]*ldap.Entry
+	reads int
+
+	// truncated is set if some memberships were not returned because the depth or object limit was reached
+	truncated bool
+}
+
+func newMembershipResolver(conn *pooledConn, base string, attributes []string, maxDepth int, inChain bool) *membershipResolver {
+	return &membershipResolver{
+		conn:       conn,
+		base:       base,
+		attributes: attributes,
+		maxDepth:   maxDepth,
+		inChain:    inChain,
+		cache:      make(map[string]*ldap.Entry),
+	}
+}
+
+// members finds every object which is a member of the group, directly or through nested groups
+func (m *membershipResolver) members(group string) ([]membershipHit, error) {
+	if !m.inChain {
+		hits, err := m.walk(group, m.readMembers)
+		if err != nil {
+			return nil, err
+		}
+
+		return m.withinBase(hits), nil
+	}
+
+	entries, err := m.searchAll(fmt.Sprintf("(memberOf:%s:=%s)", matchingRuleInChain, ldap.EscapeFilter(group)), "memberOf")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each object names the groups it is in, so the path to it is found by following memberOf backwards from the group
+	children := make(map[string][]*ldap.Entry)
+	for _, e := range entries {
+		for _, g := range rawValues(e, "memberOf") {
+			children[dnKey(g)] = append(children[dnKey(g)], e)
+		}
+	}
+
+	hits, err := m.walk(group, func(dn string) ([]*ldap.Entry, error) {
+		return children[dnKey(dn)], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.unreachable(hits, entries, group), nil
+}
+
+// groups finds every group which the object is a member of, directly or through nested groups
+func (m *membershipResolver) groups(member string) ([]membershipHit, error) {
+	if !m.inChain {
+		return m.walk(member, func(dn string) ([]*ldap.Entry, error) {
+			return m.searchAll(fmt.Sprintf("(member=%s)", ldap.EscapeFilter(dn)))
+		})
+	}
+
+	entries, err := m.searchAll(fmt.Sprintf("(member:%s:=%s)", matchingRuleInChain, ldap.EscapeFilter(member)), "memberOf")
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := m.readEntry(member, "memberOf")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*ldap.Entry)
+	for _, e := range entries {
+		groups[dnKey(e.DN)] = e
+	}
+	groups[dnKey(member)] = start
+
+	hits, err := m.walk(member, func(dn string) ([]*ldap.Entry, error) {
+		var parents []*ldap.Entry
+
+		if e, ok := groups[dnKey(dn)]; ok {
+			for _, g := range rawValues(e, "memberOf") {
+				if parent, ok := groups[dnKey(g)]; ok {
+					parents = append(parents, parent)
+				}
+			}
+		}
+
+		return parents, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.unreachable(hits, entries, member), nil
+}
+
+// walk finds every object reachable from start, breadth first so that each object is found by its shortest path.
+// next returns the objects one step on from an object; its members when looking for members, or its groups when looking for groups.
+func (m *membershipResolver) walk(start string, next func(dn string) ([]*ldap.Entry, error)) ([]membershipHit, error) {
+	type step struct {
+		dn   string
+		path []string
+	}
+
+	visited := map[string]bool{dnKey(start): true}
+	queue := []step{{start, []string{start}}}
+
+	var hits []membershipHit
+
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		entries, err := next(s.dn)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			k := dnKey(e.DN)
+			if visited[k] {
+				continue
+			}
+
+			// The path includes the start, so its length is the depth of the objects found from this step.
+			// Objects at the depth limit are still looked at, so that we know whether anything was left out.
+			if len(hits) >= maxMembershipObjects {
+				m.truncated = true
+				return hits, nil
+			}
+
+			if len(s.path) > m.maxDepth {
+				m.truncated = true
+				break
+			}
+
+			visited[k] = true
+
+			path := append(append([]string{}, s.path...), e.DN)
+			hits = append(hits, membershipHit{entry: e, path: path})
+			queue = append(queue, step{e.DN, path})
+		}
+	}
+
+	return hits, nil
+}
+
+// unreachable adds any objects which the directory says are in the chain, but which can't be linked to the start using memberOf,
+// e.g. because a group in between is outside the search base.
+// They are returned without a path, unless the depth or object limit was reached, in which case they may simply be too far away.
+// The start is never returned, even if it is a member of itself through a cycle.
+func (m *membershipResolver) unreachable(hits []membershipHit, entries []*ldap.Entry, start string) []membershipHit {
+	if m.truncated {
+		return hits
+	}
+
+	found := map[string]bool{dnKey(start): true}
+	for _, h := range hits {
+		found[dnKey(h.entry.DN)] = true
+	}
+
+	for _, e := range entries {
+		if len(hits) >= maxMembershipObjects {
+			m.truncated = true
+			break
+		}
+
+		if !found[dnKey(e.DN)] {
+			hits = append(hits, membershipHit{entry: e})
+		}
+	}
+
+	return hits
+}
+
+// withinBase drops any objects which are not under the search base.
+// Walking the members of a group follows nested groups wherever they are, so that members under the base aren't missed.
+func (m *membershipResolver) withinBase(hits []membershipHit) []membershipHit {
+	base, err := ldap.ParseDN(m.base)
+	if err != nil {
+		return hits
+	}
+	base = foldDN(base)
+
+	var within []membershipHit
+	for _, h := range hits {
+		dn, err := ldap.ParseDN(h.entry.DN)
+		if err == nil && (base.Equal(foldDN(dn)) || base.AncestorOf(foldDN(dn))) {
+			within = append(within, h)
+		}
+	}
+
+	return within
+}
+
+// readMembers reads the direct members of a group; objects which aren't groups have no members
+func (m *membershipResolver) readMembers(dn string) ([]*ldap.Entry, error) {
+	group, err := m.readEntry(dn, "member")
+	if err != nil {
+		return nil, err
+	}
+
+	var members []*ldap.Entry
+	for _, v := range rawValues(group, "member") {
+		// Each member is read separately, so the object limit is checked as they are read;
+		// otherwise a single huge group would be read in full before the limit is applied to the results
+		if _, ok := m.cache[dnKey(v)]; !ok && m.reads >= maxMembershipObjects {
+			m.truncated = true
+			break
+		}
+
+		member, err := m.readEntry(v, "member")
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// readEntry reads an object, along with the attributes requested by the consumer and any extra attributes needed to follow its memberships.
+// Groups can name members which no longer exist, or which can't be read, so a missing object is returned without any attributes rather than failing the query.
+func (m *membershipResolver) readEntry(dn string, extra ...string) (*ldap.Entry, error) {
+	if e, ok := m.cache[dnKey(dn)]; ok {
+		return e, nil
+	}
+
+	attributes := append(append([]string{}, m.attributes...), extra...)
+
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		attributes,
+		nil,
+	)
+
+	entry := ldap.NewEntry(dn, nil)
+
+	m.reads++
+
+	res, err := m.conn.Search(searchRequest)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, errors.Wrapf(err, "unable to read %s", dn)
+	}
+
+	if err == nil && len(res.Entries) == 1 {
+		err = retrieveRanges(m.conn, res.Entries, attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		entry = res.Entries[0]
+	}
+
+	m.cache[dnKey(dn)] = entry
+
+	return entry, nil
+}
+
+// searchAll finds every object under the base matching the filter, along with the attributes requested by the consumer and any extra attributes
+func (m *membershipResolver) searchAll(filter string, extra ...string) ([]*ldap.Entry, error) {
+	attributes := append(append([]string{}, m.attributes...), extra...)
+
+	searchRequest := ldap.NewSearchRequest(
+		m.base,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		filter,
+		attributes,
+		nil,
+	)
+
+	search := newPagedSearch(m.conn, searchRequest, maxPageSize, 0)
+
+	var all []*ldap.Entry
+	for !search.done {
+		entries, err := search.next()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to search for %s", filter)
+		}
+
+		err = retrieveRanges(m.conn, entries, attributes)
+		if err != nil {
+			search.abandon()
+			return nil, err
+		}
+
+		all = append(all, entries...)
+	}
+
+	if search.truncated {
+		m.truncated = true
+	}
+
+	return all, nil
+}
+
+// dnKey gives DNs which only differ in case or spacing the same key, so that an object is recognised however its DN is written
+func dnKey(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+
+	var rdns []string
+	for _, rdn := range foldDN(parsed).RDNs {
+		var attributes []string
+		for _, a := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(a.Type)+"="+a.Value)
+		}
+
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+
+	return strings.Join(rdns, ",")
+}
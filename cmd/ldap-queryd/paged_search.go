@@ -0,0 +1,101 @@
+package main
+
+import (
+	ldap "gopkg.in/ldap.v3"
+)
+
+// pagedSearch reads the results of a search from the directory a page at a time, using the paged results control (RFC 2696).
+//
+// The size limit is applied here, rather than by the directory, as the ldap package throws away every entry in a page
+// if the directory reports that the size limit has been exceeded.
+type pagedSearch struct {
+	conn    *pooledConn
+	request *ldap.SearchRequest
+	paging  *ldap.ControlPaging
+
+	sizeLimit int
+	returned  int
+
+	// controls are the response controls sent by the directory with the last page
+	controls []ldap.Control
+
+	// truncated is set if the search stopped before all of the results were read because the size or time limit was reached
+	truncated bool
+	done      bool
+}
+
+// newPagedSearch starts a search which reads pageSize entries at a time.
+// If pageSize is 0, the paging control is not sent and every entry is read in one go; this is needed for controls, such as
+// the virtual list view, which cannot be used alongside paging.
+func newPagedSearch(conn *pooledConn, request *ldap.SearchRequest, pageSize int, sizeLimit int) *pagedSearch {
+	s := &pagedSearch{
+		conn:      conn,
+		request:   request,
+		sizeLimit: sizeLimit,
+	}
+
+	if pageSize > 0 {
+		s.paging = ldap.NewControlPaging(uint32(pageSize))
+		request.Controls = append(request.Controls, s.paging)
+	}
+
+	return s
+}
+
+// next reads the next page of entries from the directory.
+// Once there are no more pages to read, done is set.
+func (s *pagedSearch) next() ([]*ldap.Entry, error) {
+	res, err := s.conn.Search(s.request)
+	if err != nil {
+		s.done = true
+
+		// Anything returned in earlier pages is still valid, so let the consumer have it rather than failing the whole search
+		if ldapErr, ok := err.(*ldap.Error); ok && ldapErr.ResultCode == ldap.LDAPResultTimeLimitExceeded {
+			s.truncated = true
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	s.controls = res.Controls
+	entries := res.Entries
+
+	if s.sizeLimit > 0 && s.returned+len(entries) > s.sizeLimit {
+		entries = entries[:s.sizeLimit-s.returned]
+		s.truncated = true
+	}
+
+	s.returned += len(entries)
+
+	var cookie []byte
+	if control, ok := ldap.FindControl(res.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok {
+		cookie = control.Cookie
+	}
+
+	if len(cookie) == 0 {
+		s.done = true
+		return entries, nil
+	}
+
+	s.paging.SetCookie(cookie)
+
+	if s.sizeLimit > 0 && s.returned >= s.sizeLimit {
+		s.truncated = true
+		s.abandon()
+	}
+
+	return entries, nil
+}
+
+// abandon tells the directory that no more pages will be read, so that it can free up the resources held for the search
+func (s *pagedSearch) abandon() {
+	s.done = true
+
+	if s.paging == nil {
+		return
+	}
+
+	s.paging.PagingSize = 0
+	s.conn.Search(s.request)
+}
@@ -3,59 +3,131 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 )
 
 // Query contains the possible parameters that can be passed in the request body when carrying out a search against an LDAP directory
-// Filter = needs to be a valid LDAP filter
+// Filter = needs to be a valid LDAP filter, as defined in RFC 4515
+// StructuredFilter = alternative to Filter, built from JSON with the values escaped; see filterNode
 // Base = defines the base OU of the search
 // Scope = one of base, one, or sub to define what is searched
 // Attributes = array of strings with the attributes to return from the search
+// Directory = name of the directory to search, if not given in the URL; defaults to the first directory configured
+// AllValues = return every attribute as an array of all of its values, rather than just the first value
+// SizeLimit = maximum number of entries to return across all pages; 0 for no limit
+// TimeLimit = maximum number of seconds the directory spends on each page of the search; 0 for no limit
+// PageSize = return this many entries at a time, with a cursor to fetch the next page
+// Cursor = the cursor returned with the previous page, to fetch the next page
+// Stream = send each entry as a line of JSON as soon as it has been read from the directory; the same as sending Accept: application/x-ndjson
+// Sort = list of attributes to sort the results by, each with an optional direction (asc or desc) and matching rule
+// VLV = return a window onto the sorted results, rather than all of them; see vlvRequest
+// Format = one of json, ndjson, csv or ldif; if not given, the Accept header is used, and then json
+// CSVHeader = include a header row with the attribute names in CSV output; defaults to true
+// CSVSeparator = string used to join multiple values of an attribute in CSV output; defaults to |
+// Decode = convert AD timestamps to RFC 3339, and expand flag attributes such as userAccountControl into the names of the flags which are set
 type Query struct {
 	// REQUIRED parameter(s)
 	Filter     string   `json:"filter"`
 	Base       string   `json:"base"`
 	Attributes []string `json:"attributes"`
 
+	// Can be used instead of Filter
+	StructuredFilter filterNode `json:"structuredFilter"`
+
 	// OPTIONAL parameter(s)
-	Scope string `json:"scope"`
+	Scope     string `json:"scope"`
+	Directory string `json:"directory"`
+	AllValues bool   `json:"allValues"`
+	Decode    bool   `json:"decode"`
+	SizeLimit int    `json:"sizeLimit"`
+	TimeLimit int    `json:"timeLimit"`
+	PageSize  int    `json:"pageSize"`
+	Cursor    string `json:"cursor"`
+	Stream    bool   `json:"stream"`
+
+	Sort []sortKey   `json:"sort"`
+	VLV  *vlvRequest `json:"vlv"`
+
+	Format       string `json:"format"`
+	CSVHeader    bool   `json:"csvHeader"`
+	CSVSeparator string `json:"csvSeparator"`
 }
 
+// The largest page which can be requested, which is also the page size used to read the directory when the consumer doesn't ask for paging
+const maxPageSize = 10000
+
 // ValidationError contains the parameter with the error and a friendly error message
 type ValidationError struct {
 	Parameter string `json:"parameter"`
 	Error     string `json:"error"`
 }
 
-// Validate ensures that the query passed is valid
+// Validate ensures that the query passed is valid.
+// If a structured filter has been passed, Filter is set to the filter built from it.
 func (q *Query) Validate() ([]ValidationError, error) {
 	var ve []ValidationError
 
 	regexScope := `(?i)^(base|one|sub)$`
-	regexBase := `(?i)^(?:ou=[^,]*,?)*(?:dc=[^,]*,?)*$`
+	regexFormat := `(?i)^(json|ndjson|csv|ldif)?$`
+	regexSortDirection := `(?i)^(asc|desc)?$`
 
 	// REQUIRED parameter validation
-	if q.Filter == "" {
+	if q.Filter == "" && q.StructuredFilter == nil {
 		ve = append(ve, ValidationError{
 			Parameter: "filter",
-			Error:     "REQUIRED field",
+			Error:     "REQUIRED field, unless structuredFilter is used",
 		})
 	}
 
-	if q.Base == "" {
+	if q.Filter != "" && q.StructuredFilter != nil {
 		ve = append(ve, ValidationError{
-			Parameter: "base",
-			Error:     "REQUIRED field",
+			Parameter: "structuredFilter",
+			Error:     "filter and structuredFilter cannot both be used",
 		})
 	}
 
-	if q.Base != "" && !regexp.MustCompile(regexBase).MatchString(q.Base) {
+	// The structured filter is translated into a filter string, which is then validated and used in the same way as any other filter
+	if q.Filter == "" && q.StructuredFilter != nil {
+		filter, err := q.StructuredFilter.build("structuredFilter")
+		if err != nil {
+			ve = append(ve, ValidationError{
+				Parameter: "structuredFilter",
+				Error:     err.Error(),
+			})
+		}
+
+		q.Filter = filter
+	}
+
+	if q.Filter != "" {
+		err := validateFilter(q.Filter)
+		if err != nil {
+			ve = append(ve, ValidationError{
+				Parameter: "filter",
+				Error:     fmt.Sprintf("filter is not valid: %s", err),
+			})
+		}
+	}
+
+	if q.Base == "" {
 		ve = append(ve, ValidationError{
 			Parameter: "base",
-			Error:     "base does not appear to be a valid LDAP path",
+			Error:     "REQUIRED field",
 		})
 	}
 
+	if q.Base != "" {
+		_, err := parseDN(q.Base)
+		if err != nil {
+			ve = append(ve, ValidationError{
+				Parameter: "base",
+				Error:     fmt.Sprintf("base is not a valid DN: %s", err),
+			})
+		}
+	}
+
 	if len(q.Attributes) == 0 {
 		ve = append(ve, ValidationError{
 			Parameter: "attributes",
@@ -71,6 +143,96 @@ func (q *Query) Validate() ([]ValidationError, error) {
 		})
 	}
 
+	for i, k := range q.Sort {
+		if !validAttributeDescription.MatchString(k.Attribute) {
+			ve = append(ve, ValidationError{
+				Parameter: "sort",
+				Error:     fmt.Sprintf("sort[%d]: %q is not a valid attribute name", i, k.Attribute),
+			})
+		}
+
+		if !regexp.MustCompile(regexSortDirection).MatchString(k.Direction) {
+			ve = append(ve, ValidationError{
+				Parameter: "sort",
+				Error:     fmt.Sprintf("sort[%d]: If specified, direction MUST be one of 'asc' or 'desc'", i),
+			})
+		}
+
+		if k.MatchingRule != "" && !validAttributeType.MatchString(k.MatchingRule) {
+			ve = append(ve, ValidationError{
+				Parameter: "sort",
+				Error:     fmt.Sprintf("sort[%d]: %q is not a valid matching rule", i, k.MatchingRule),
+			})
+		}
+	}
+
+	if q.VLV != nil {
+		ve = append(ve, q.VLV.validate()...)
+
+		if len(q.Sort) == 0 {
+			ve = append(ve, ValidationError{
+				Parameter: "vlv",
+				Error:     "vlv can only be used with sort, as the virtual list view is a window onto the sorted results",
+			})
+		}
+
+		if q.PageSize > 0 || q.Cursor != "" {
+			ve = append(ve, ValidationError{
+				Parameter: "vlv",
+				Error:     "vlv cannot be used with pageSize or cursor; use beforeCount and afterCount to choose how many entries are returned",
+			})
+		}
+	}
+
+	if !regexp.MustCompile(regexFormat).MatchString(q.Format) {
+		ve = append(ve, ValidationError{
+			Parameter: "format",
+			Error:     "If specified, format MUST be one of 'json', 'ndjson', 'csv', or 'ldif'",
+		})
+	}
+
+	if q.Stream && q.Format != "" && strings.ToLower(q.Format) != formatNDJSON {
+		ve = append(ve, ValidationError{
+			Parameter: "stream",
+			Error:     "stream can only be used with the 'ndjson' format",
+		})
+	}
+
+	if q.CSVSeparator == "" {
+		ve = append(ve, ValidationError{
+			Parameter: "csvSeparator",
+			Error:     "csvSeparator cannot be empty",
+		})
+	}
+
+	if q.SizeLimit < 0 {
+		ve = append(ve, ValidationError{
+			Parameter: "sizeLimit",
+			Error:     "sizeLimit cannot be negative; use 0 for no limit",
+		})
+	}
+
+	if q.TimeLimit < 0 {
+		ve = append(ve, ValidationError{
+			Parameter: "timeLimit",
+			Error:     "timeLimit cannot be negative; use 0 for no limit",
+		})
+	}
+
+	if q.PageSize < 0 || q.PageSize > maxPageSize {
+		ve = append(ve, ValidationError{
+			Parameter: "pageSize",
+			Error:     fmt.Sprintf("If specified, pageSize MUST be between 1 and %d", maxPageSize),
+		})
+	}
+
+	if q.Cursor != "" && q.PageSize == 0 {
+		ve = append(ve, ValidationError{
+			Parameter: "cursor",
+			Error:     "cursor can only be used with the pageSize of the query which returned it",
+		})
+	}
+
 	if len(ve) > 0 {
 		return ve, errors.New("validation failed")
 	}
@@ -82,6 +244,8 @@ func (q *Query) Validate() ([]ValidationError, error) {
 func (q *Query) UnmarshalJSON(data []byte) error {
 	// Set default values before unmarshaling
 	q.Scope = "base"
+	q.CSVHeader = true
+	q.CSVSeparator = "|"
 
 	// Creating an Alias type prevents an endless loop
 	type Alias Query
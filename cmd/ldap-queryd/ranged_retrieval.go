@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// AD returns large multi-valued attributes, such as the member attribute of big groups, a range of values at a time.
+// The attribute is returned as e.g. member;range=0-1499, and the next range is requested using member;range=1500-*;
+// the last range ends with * instead of a number.
+var rangeOption = regexp.MustCompile(`(?i)^range=(\d+)-(\d+|\*)$`)
+
+// Stop following ranges if the directory never returns the last one; at 1500 values a range, this is still millions of values
+const maxRangedRetrievals = 10000
+
+// splitRange removes the range option from an attribute description, returning the description without it along with the range.
+// ok is false if the attribute has no range option.
+func splitRange(attribute string) (name string, low int, high int, last bool, ok bool) {
+	base, options := splitAttributeOptions(attribute)
+
+	var rest []string
+	for _, o := range options {
+		m := rangeOption.FindStringSubmatch(o)
+		if m == nil {
+			rest = append(rest, o)
+			continue
+		}
+
+		low, _ = strconv.Atoi(m[1])
+		if m[2] == "*" {
+			last = true
+		} else {
+			high, _ = strconv.Atoi(m[2])
+		}
+		ok = true
+	}
+
+	return strings.Join(append([]string{base}, rest...), ";"), low, high, last, ok
+}
+
+// retrieveRanges fetches the remaining values of any attributes which the directory returned as a range, so that consumers get every value.
+// The values are merged into a single attribute under the name without the range option.
+// Attributes which the consumer asked for a specific range of are left as they are.
+func retrieveRanges(conn *pooledConn, entries []*ldap.Entry, requested []string) error {
+	for _, entry := range entries {
+		for _, attr := range entry.Attributes {
+			name, _, high, last, ok := splitRange(attr.Name)
+			if !ok || rangeRequested(name, requested) {
+				continue
+			}
+
+			attr.Name = name
+
+			for i := 0; !last; i++ {
+				if i == maxRangedRetrievals {
+					return errors.Errorf("directory did not return the last range of values of %s for %s", name, entry.DN)
+				}
+
+				values, byteValues, h, l, err := readRange(conn, entry.DN, name, high+1)
+				if err != nil {
+					return err
+				}
+
+				attr.Values = append(attr.Values, values...)
+				attr.ByteValues = append(attr.ByteValues, byteValues...)
+				high, last = h, l
+			}
+		}
+	}
+
+	return nil
+}
+
+// rangeRequested checks whether the consumer asked for a specific range of an attribute, e.g. member;range=0-99
+func rangeRequested(name string, requested []string) bool {
+	for _, r := range requested {
+		n, _, _, _, ok := splitRange(r)
+		if ok && strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readRange reads the values of an attribute of an entry, starting from low, returning the end of the range the directory sent back
+func readRange(conn *pooledConn, dn string, attribute string, low int) ([]string, [][]byte, int, bool, error) {
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		[]string{fmt.Sprintf("%s;range=%d-*", attribute, low)},
+		nil,
+	)
+
+	res, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, nil, 0, false, errors.Wrapf(err, "unable to read values of %s for %s", attribute, dn)
+	}
+
+	if len(res.Entries) == 1 {
+		for _, attr := range res.Entries[0].Attributes {
+			name, l, high, last, ok := splitRange(attr.Name)
+			if !ok || !strings.EqualFold(name, attribute) {
+				continue
+			}
+
+			if l != low {
+				break
+			}
+
+			return attr.Values, attr.ByteValues, high, last, nil
+		}
+	}
+
+	return nil, nil, 0, false, errors.Errorf("directory did not return the range of values of %s starting at %d for %s", attribute, low, dn)
+}
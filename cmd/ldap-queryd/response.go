@@ -12,6 +12,27 @@ type Response struct {
 	Error   string       `json:"error,omitempty"`
 	TraceID string       `json:"trace_id,omitempty"`
 	Result  []ldapObject `json:"result,omitempty"`
+
+	// Set when a paged search has more pages to fetch
+	Cursor string `json:"cursor,omitempty"`
+
+	// Set when the search stopped early because the size or time limit was reached
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Anything the consumer should know about how the search was carried out, such as falling back to sorting the results in the service
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Set when the query asked for a virtual list view, with the position of the target entry and the length of the list
+	VLV *vlvResult `json:"vlv,omitempty"`
+
+	// Set in response to a membership check
+	IsMember *bool `json:"isMember,omitempty"`
+
+	// Set in response to a request for the root DSE
+	RootDSE *rootDSE `json:"rootDSE,omitempty"`
+
+	// Set in response to a request for the schema
+	Schema *schema `json:"schema,omitempty"`
 }
 
 // Send API response back to client
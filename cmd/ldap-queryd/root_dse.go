@@ -0,0 +1,254 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// How long the root DSE of each directory server is cached for.
+// It rarely changes, but is cached per host as the servers behind a directory are not guaranteed to be the same.
+const rootDSECacheDuration = time.Minute
+
+// Capability advertised by Active Directory domain controllers; see MS-ADTS
+const capabilityActiveDirectory = "1.2.840.113556.1.4.800"
+
+// rootDSE holds the details a directory server publishes about itself.
+// CurrentTime is converted to RFC 3339 if possible; as the root DSE is cached, it is worked out from the time on the server when it was read.
+type rootDSE struct {
+	NamingContexts          []string `json:"namingContexts,omitempty"`
+	DefaultNamingContext    string   `json:"defaultNamingContext,omitempty"`
+	SupportedControl        []string `json:"supportedControl,omitempty"`
+	SupportedExtension      []string `json:"supportedExtension,omitempty"`
+	SupportedSASLMechanisms []string `json:"supportedSASLMechanisms,omitempty"`
+	SupportedCapabilities   []string `json:"supportedCapabilities,omitempty"`
+	SubschemaSubentry       string   `json:"subschemaSubentry,omitempty"`
+	DNSHostName             string   `json:"dnsHostName,omitempty"`
+	CurrentTime             string   `json:"currentTime,omitempty"`
+}
+
+// The root DSE attributes which are read; directories don't return operational attributes unless they are asked for by name
+var rootDSEAttributes = []string{
+	"namingContexts",
+	"defaultNamingContext",
+	"supportedControl",
+	"supportedExtension",
+	"supportedSASLMechanisms",
+	"supportedCapabilities",
+	"subschemaSubentry",
+	"dnsHostName",
+	"currentTime",
+}
+
+type cachedRootDSE struct {
+	rootDSE rootDSE
+	read    time.Time
+	expires time.Time
+
+	// currentTime is the time on the server when the root DSE was read, if it could be parsed
+	currentTime time.Time
+}
+
+// current returns the cached root DSE, with the current time of the server moved on by however long it has been cached for
+func (c cachedRootDSE) current() rootDSE {
+	dse := c.rootDSE
+
+	if !c.currentTime.IsZero() {
+		dse.CurrentTime = c.currentTime.Add(time.Since(c.read)).UTC().Format(time.RFC3339)
+	}
+
+	return dse
+}
+
+// supportsControl checks whether the directory server advertises support for a control
+func (r rootDSE) supportsControl(oid string) bool {
+	for _, c := range r.SupportedControl {
+		if c == oid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isActiveDirectory checks whether the directory server is an AD domain controller, so that AD specific features can be used
+func (r rootDSE) isActiveDirectory() bool {
+	for _, c := range r.SupportedCapabilities {
+		if c == capabilityActiveDirectory {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rootDSE returns the root DSE of the directory server the connection is to, reading it from the server if it is not already cached
+func (p *connPool) rootDSE(conn *pooledConn) (rootDSE, error) {
+	p.mu.Lock()
+	cached, ok := p.rootDSEs[conn.host]
+	p.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.current(), nil
+	}
+
+	dse, err := readRootDSE(conn)
+	if err != nil {
+		return dse, err
+	}
+
+	now := time.Now()
+
+	cached = cachedRootDSE{
+		rootDSE: dse,
+		read:    now,
+		expires: now.Add(rootDSECacheDuration),
+	}
+
+	if t, err := time.Parse(time.RFC3339, dse.CurrentTime); err == nil {
+		cached.currentTime = t
+	}
+
+	p.mu.Lock()
+	p.rootDSEs[conn.host] = cached
+	p.mu.Unlock()
+
+	return dse, nil
+}
+
+func readRootDSE(conn *pooledConn) (rootDSE, error) {
+	var dse rootDSE
+
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		rootDSEAttributes,
+		nil,
+	)
+
+	res, err := conn.Search(searchRequest)
+	if err != nil {
+		return dse, errors.Wrap(err, "unable to read root DSE")
+	}
+
+	if len(res.Entries) == 0 {
+		return dse, errors.New("directory did not return a root DSE")
+	}
+
+	entry := res.Entries[0]
+
+	for _, attr := range entry.Attributes {
+		if len(attr.Values) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(attr.Name) {
+		case "namingcontexts":
+			dse.NamingContexts = attr.Values
+		case "defaultnamingcontext":
+			dse.DefaultNamingContext = attr.Values[0]
+		case "supportedcontrol":
+			dse.SupportedControl = attr.Values
+		case "supportedextension":
+			dse.SupportedExtension = attr.Values
+		case "supportedsaslmechanisms":
+			dse.SupportedSASLMechanisms = attr.Values
+		case "supportedcapabilities":
+			dse.SupportedCapabilities = attr.Values
+		case "subschemasubentry":
+			dse.SubschemaSubentry = attr.Values[0]
+		case "dnshostname":
+			dse.DNSHostName = attr.Values[0]
+		case "currenttime":
+			dse.CurrentTime = attr.Values[0]
+			if t, ok := decodeGeneralizedTime(attr.Values[0]); ok {
+				dse.CurrentTime = t
+			}
+		}
+	}
+
+	return dse, nil
+}
+
+// describeDirectory returns the root DSE of one of the servers behind a directory, so that consumers can discover its naming contexts
+// and what it supports, rather than hardcoding them
+func describeDirectory(pools directoryPools, logger *logrus.Entry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The traceID is included in every log entry, and in HTTP responses, to allow for correlation of logs
+		traceID := r.Context().Value(traceIDCtxKey).(string)
+
+		APIResponse := Response{
+			TraceID: traceID,
+		}
+
+		// The clientIP is included in every log entry for later analysis
+		clientIP := r.Context().Value(clientIPCtxKey).(string)
+
+		// The client is the name the caller authenticated as, or the clientIP if it did not; it is included in every log entry and in some metrics
+		client := clientName(r)
+
+		// The endpoint is only served under /directories/{name}, so the directory always comes from the URL
+		directoryName, _ := r.Context().Value(directoryCtxKey).(string)
+		pool, _ := pools.get(directoryName)
+
+		start := time.Now()
+
+		ldapConn, err := pool.get(r.Context())
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "bind", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "describeDirectory",
+				"error":     err,
+			}).Error("unable to bind to directory")
+
+			APIResponse.Message = "unable to bind to directory"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		dse, err := pool.rootDSE(ldapConn)
+		pool.put(ldapConn, errors.Cause(err))
+
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "rootdse", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "describeDirectory",
+				"error":     err,
+			}).Error("unable to read root DSE")
+
+			APIResponse.Message = "unable to read root DSE"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		duration := time.Since(start)
+		requestDuration.WithLabelValues(directoryName, strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
+
+		APIResponse.RootDSE = &dse
+		APIResponse.Send(http.StatusOK, w)
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// How long the schema of each directory is cached for; it only changes when the schema is extended, which is rare
+const schemaCacheDuration = 15 * time.Minute
+
+// schema holds the attribute types and object classes defined by a directory, parsed from its subschema subentry
+type schema struct {
+	AttributeTypes []attributeType `json:"attributeTypes"`
+	ObjectClasses  []objectClass   `json:"objectClasses"`
+
+	// attributes indexes the attribute types by their lower case names and OIDs
+	attributes map[string]*attributeType
+}
+
+// attributeType is an attribute type definition; see RFC 4512 section 4.1.2.
+// If the syntax isn't given, it is inherited from the supertype.
+type attributeType struct {
+	OID          string   `json:"oid"`
+	Names        []string `json:"names"`
+	Description  string   `json:"description,omitempty"`
+	Sup          string   `json:"sup,omitempty"`
+	Syntax       string   `json:"syntax,omitempty"`
+	SingleValued bool     `json:"singleValued"`
+}
+
+// objectClass is an object class definition; see RFC 4512 section 4.1.1.
+// Kind is one of ABSTRACT, STRUCTURAL or AUXILIARY. Must and May only list the attributes of the class itself, not those inherited from Sup.
+type objectClass struct {
+	OID         string   `json:"oid"`
+	Names       []string `json:"names"`
+	Description string   `json:"description,omitempty"`
+	Sup         []string `json:"sup,omitempty"`
+	Kind        string   `json:"kind"`
+	Must        []string `json:"must,omitempty"`
+	May         []string `json:"may,omitempty"`
+}
+
+type cachedSchema struct {
+	schema  *schema
+	expires time.Time
+}
+
+// schema returns the schema of the directory, reading it from the directory if it is not already cached
+func (p *connPool) schema(conn *pooledConn) (*schema, error) {
+	p.mu.Lock()
+	cached := p.cachedSchema
+	p.mu.Unlock()
+
+	if cached.schema != nil && time.Now().Before(cached.expires) {
+		return cached.schema, nil
+	}
+
+	dse, err := p.rootDSE(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if dse.SubschemaSubentry == "" {
+		return nil, errors.New("directory does not publish a subschema subentry")
+	}
+
+	s, err := readSchema(conn, dse.SubschemaSubentry)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cachedSchema = cachedSchema{
+		schema:  s,
+		expires: time.Now().Add(schemaCacheDuration),
+	}
+	p.mu.Unlock()
+
+	return s, nil
+}
+
+// readSchema reads the attribute types and object classes from the subschema subentry.
+// AD publishes the subschema subentry as well as the classSchema and attributeSchema objects, so the same approach works for every directory.
+func readSchema(conn *pooledConn, subschemaSubentry string) (*schema, error) {
+	attributes := []string{"attributeTypes", "objectClasses"}
+
+	searchRequest := ldap.NewSearchRequest(
+		subschemaSubentry,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		attributes,
+		nil,
+	)
+
+	res, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read schema")
+	}
+
+	if len(res.Entries) == 0 {
+		return nil, errors.New("directory did not return the subschema subentry")
+	}
+
+	err = retrieveRanges(conn, res.Entries, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &schema{
+		attributes: make(map[string]*attributeType),
+	}
+
+	entry := res.Entries[0]
+
+	for _, v := range rawValues(entry, "attributeTypes") {
+		d, err := parseSchemaDefinition(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse attribute type %s", v)
+		}
+
+		s.AttributeTypes = append(s.AttributeTypes, attributeType{
+			OID:          d.oid,
+			Names:        d.values["NAME"],
+			Description:  d.first("DESC"),
+			Sup:          d.first("SUP"),
+			Syntax:       d.first("SYNTAX"),
+			SingleValued: d.has("SINGLE-VALUE"),
+		})
+	}
+
+	for _, v := range rawValues(entry, "objectClasses") {
+		d, err := parseSchemaDefinition(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse object class %s", v)
+		}
+
+		// STRUCTURAL is the default, if the kind isn't given
+		kind := "STRUCTURAL"
+		for _, k := range []string{"ABSTRACT", "AUXILIARY"} {
+			if d.has(k) {
+				kind = k
+			}
+		}
+
+		s.ObjectClasses = append(s.ObjectClasses, objectClass{
+			OID:         d.oid,
+			Names:       d.values["NAME"],
+			Description: d.first("DESC"),
+			Sup:         d.values["SUP"],
+			Kind:        kind,
+			Must:        d.values["MUST"],
+			May:         d.values["MAY"],
+		})
+	}
+
+	for i := range s.AttributeTypes {
+		a := &s.AttributeTypes[i]
+
+		s.attributes[strings.ToLower(a.OID)] = a
+		for _, n := range a.Names {
+			s.attributes[strings.ToLower(n)] = a
+		}
+	}
+
+	s.inherit()
+
+	return s, nil
+}
+
+// inherit fills in the syntax of attribute types which only give it through their supertype, e.g. cn in OpenLDAP, which is a subtype of name
+func (s *schema) inherit() {
+	for i := range s.AttributeTypes {
+		a := &s.AttributeTypes[i]
+
+		// The chain is bounded, in case the schema has a loop in it
+		sup := a.Sup
+		for depth := 0; a.Syntax == "" && sup != "" && depth < len(s.AttributeTypes); depth++ {
+			parent, ok := s.attributes[strings.ToLower(sup)]
+			if !ok {
+				break
+			}
+
+			a.Syntax = parent.Syntax
+			sup = parent.Sup
+		}
+	}
+}
+
+// unknownAttributes returns a warning for each attribute used by the query which is not defined in the schema
+func (s *schema) unknownAttributes(query Query) []string {
+	var attributes []string
+	attributes = append(attributes, query.Attributes...)
+	for _, k := range query.Sort {
+		attributes = append(attributes, k.Attribute)
+	}
+
+	var warnings []string
+	for _, a := range attributes {
+		name, _ := splitAttributeOptions(a)
+
+		// Special attribute selectors, and distinguishedName, which the service always understands, even if the directory doesn't
+		switch strings.ToLower(name) {
+		case "*", "+", "1.1", "distinguishedname":
+			continue
+		}
+
+		if _, ok := s.attributes[strings.ToLower(name)]; !ok {
+			warnings = append(warnings, fmt.Sprintf("attribute '%s' is not defined in the directory schema", name))
+		}
+	}
+
+	return warnings
+}
+
+// schemaDefinition is a parsed attribute type or object class description, which have the same general form; see RFC 4512 section 4.1.
+//
+//	( 2.5.4.3 NAME ( 'cn' 'commonName' ) SUP name )
+//
+// Each keyword is held with its values; keywords without values, such as SINGLE-VALUE, have none.
+type schemaDefinition struct {
+	oid    string
+	values map[string][]string
+}
+
+func (d schemaDefinition) first(keyword string) string {
+	if v := d.values[keyword]; len(v) > 0 {
+		return v[0]
+	}
+
+	return ""
+}
+
+func (d schemaDefinition) has(keyword string) bool {
+	_, ok := d.values[keyword]
+	return ok
+}
+
+// parseSchemaDefinition parses an attribute type or object class description.
+// Values can be quoted, as in NAME 'cn', or not, as in SUP name, and lists of them are wrapped in brackets, separated by spaces or $.
+// Some directories, such as AD, quote values which RFC 4512 says are not quoted, e.g. SYNTAX, so either is accepted.
+func parseSchemaDefinition(description string) (schemaDefinition, error) {
+	d := schemaDefinition{
+		values: make(map[string][]string),
+	}
+
+	tokens, err := tokeniseSchemaDefinition(description)
+	if err != nil {
+		return d, err
+	}
+
+	if len(tokens) < 3 || tokens[0] != "(" || tokens[len(tokens)-1] != ")" {
+		return d, errors.New("definition MUST be wrapped in brackets")
+	}
+
+	d.oid = strings.Trim(tokens[1], "'")
+	tokens = tokens[2 : len(tokens)-1]
+
+	var keyword string
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+
+		switch {
+		case t == "(":
+			if keyword == "" {
+				return d, errors.New("list without a keyword")
+			}
+
+			for i++; i < len(tokens) && tokens[i] != ")"; i++ {
+				if tokens[i] != "$" {
+					d.values[keyword] = append(d.values[keyword], strings.Trim(tokens[i], "'"))
+				}
+			}
+
+			if i == len(tokens) {
+				return d, errors.New("list is not closed")
+			}
+
+			keyword = ""
+		case strings.HasPrefix(t, "'"):
+			if keyword == "" {
+				return d, errors.Errorf("value %s without a keyword", t)
+			}
+
+			d.values[keyword] = append(d.values[keyword], strings.Trim(t, "'"))
+			keyword = ""
+		case keyword != "" && !isSchemaKeyword(t):
+			d.values[keyword] = append(d.values[keyword], t)
+			keyword = ""
+		default:
+			keyword = strings.ToUpper(t)
+			d.values[keyword] = nil
+		}
+	}
+
+	return d, nil
+}
+
+// isSchemaKeyword distinguishes keywords from unquoted values; keywords are upper case, such as SINGLE-VALUE, or extensions, such as X-ORIGIN
+func isSchemaKeyword(token string) bool {
+	return strings.HasPrefix(token, "X-") || (token == strings.ToUpper(token) && strings.Trim(token, "0123456789.") != "" && !strings.ContainsAny(token, "{}"))
+}
+
+// tokeniseSchemaDefinition splits a description into brackets, $ separators, quoted strings (with their quotes) and bare words
+func tokeniseSchemaDefinition(description string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(description); {
+		switch c := description[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '$':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '\'':
+			end := strings.IndexByte(description[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.Errorf("quoted string at position %d is not closed", i)
+			}
+
+			tokens = append(tokens, description[i:i+end+2])
+			i += end + 2
+		default:
+			end := strings.IndexAny(description[i:], " \t\n()$'")
+			if end < 0 {
+				end = len(description) - i
+			}
+
+			tokens = append(tokens, description[i:i+end])
+			i += end
+		}
+	}
+
+	return tokens, nil
+}
+
+// describeSchema returns the attribute types and object classes defined by a directory, so that consumers can find the right attribute names
+func describeSchema(pools directoryPools, logger *logrus.Entry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The traceID is included in every log entry, and in HTTP responses, to allow for correlation of logs
+		traceID := r.Context().Value(traceIDCtxKey).(string)
+
+		APIResponse := Response{
+			TraceID: traceID,
+		}
+
+		// The clientIP is included in every log entry for later analysis
+		clientIP := r.Context().Value(clientIPCtxKey).(string)
+
+		// The client is the name the caller authenticated as, or the clientIP if it did not; it is included in every log entry and in some metrics
+		client := clientName(r)
+
+		// The endpoint is only served under /directories/{name}, so the directory always comes from the URL
+		directoryName, _ := r.Context().Value(directoryCtxKey).(string)
+		pool, _ := pools.get(directoryName)
+
+		start := time.Now()
+
+		ldapConn, err := pool.get(r.Context())
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "bind", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "describeSchema",
+				"error":     err,
+			}).Error("unable to bind to directory")
+
+			APIResponse.Message = "unable to bind to directory"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		s, err := pool.schema(ldapConn)
+		pool.put(ldapConn, errors.Cause(err))
+
+		if err != nil {
+			queryError.WithLabelValues(directoryName, "schema", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "describeSchema",
+				"error":     err,
+			}).Error("unable to read schema")
+
+			APIResponse.Message = "unable to read schema"
+			APIResponse.Error = err.Error()
+			APIResponse.Send(http.StatusInternalServerError, w)
+
+			return
+		}
+
+		duration := time.Since(start)
+		requestDuration.WithLabelValues(directoryName, strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
+
+		APIResponse.Schema = s
+		APIResponse.Send(http.StatusOK, w)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -15,18 +16,14 @@ import (
 	ldap "gopkg.in/ldap.v3"
 )
 
-type ldapObject struct {
-	DistinguishedName string            `json:"distinguishedName,omitempty"`
-	Attributes        map[string]string `json:"attributes,omitempty"`
-}
-
 var (
 	requestDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "ldapquery_request_duration_seconds",
-			Help: "Time taken to query directory, partitioned by status code",
+			Help: "Time taken to query directory, partitioned by directory and status code",
 		},
 		[]string{
+			"directory",
 			"status_code",
 		},
 	)
@@ -34,9 +31,10 @@ var (
 	queryError = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ldapquery_errors_total",
-			Help: "Count of errors when querying directory, partitioned by operation, status code and client IP",
+			Help: "Count of errors when querying directory, partitioned by directory, operation, status code and client; the name the client authenticated as, or its IP",
 		},
 		[]string{
+			"directory",
 			"operation",
 			"status_code",
 			"client",
@@ -44,7 +42,7 @@ var (
 	)
 )
 
-func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
+func search(pools directoryPools, logger *logrus.Entry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// The traceID is included in every log entry, and in HTTP responses, to allow for correlation of logs
 		traceID := r.Context().Value(traceIDCtxKey).(string)
@@ -53,35 +51,30 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 			TraceID: traceID,
 		}
 
-		// The clientIP is included in every log entry and in some metrics for later analysis
+		// The clientIP is included in every log entry for later analysis
 		clientIP := r.Context().Value(clientIPCtxKey).(string)
 
-		ldapConn, err := bindToDC(directory, logger)
-		if err != nil {
-			logger.WithFields(logrus.Fields{
-				"trace_id":  traceID,
-				"client_ip": clientIP,
-				"function":  "search",
-				"error":     err,
-			}).Error("unable to bind to directory")
+		// The client is the name the caller authenticated as, or the clientIP if it did not; it is included in every log entry and in some metrics
+		client := clientName(r)
 
-			APIResponse.Message = "unable to bind to directory"
-			APIResponse.Error = err.Error()
-			APIResponse.Send(http.StatusInternalServerError, w)
+		// The directory can be chosen using the URL path, or by the query itself; if neither is used, the default directory is queried.
+		routedDirectory, _ := r.Context().Value(directoryCtxKey).(string)
 
-			return
+		directoryName := pools.defaultName
+		if routedDirectory != "" {
+			directoryName = routedDirectory
 		}
-		defer ldapConn.Close()
 
 		start := time.Now()
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			queryError.WithLabelValues("decode", strconv.Itoa(http.StatusInternalServerError), clientIP).Inc()
+			queryError.WithLabelValues(directoryName, "decode", strconv.Itoa(http.StatusInternalServerError), client).Inc()
 
 			logger.WithFields(logrus.Fields{
 				"trace_id":  traceID,
 				"client_ip": clientIP,
+				"client":    client,
 				"function":  "search",
 				"error":     err,
 			}).Error("unable to read HTTP request body")
@@ -96,11 +89,12 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 		query := Query{}
 		err = json.Unmarshal(body, &query)
 		if err != nil {
-			queryError.WithLabelValues("parse", strconv.Itoa(http.StatusInternalServerError), clientIP).Inc()
+			queryError.WithLabelValues(directoryName, "parse", strconv.Itoa(http.StatusInternalServerError), client).Inc()
 
 			logger.WithFields(logrus.Fields{
 				"trace_id":  traceID,
 				"client_ip": clientIP,
+				"client":    client,
 				"function":  "search",
 				"error":     err,
 				"query":     body,
@@ -116,22 +110,74 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 		logger.WithFields(logrus.Fields{
 			"trace_id":  traceID,
 			"client_ip": clientIP,
+			"client":    client,
 			"function":  "search",
 			"query":     body,
 		}).Debug("Validate query")
 
 		// We need to carry out some validation that the query passed by the user is actually valid.
-		// We can't validate the filter, but we can validate that required fields are included and that
+		// We validate that required fields are included, that the filter is syntactically correct, and that
 		// valid values have been passed for those fields which expect them.
+		// The base is also checked against the naming contexts of the directory, once we know which directory is being searched.
 		ve, err := query.Validate()
+
+		if query.Directory != "" {
+			if routedDirectory != "" && query.Directory != routedDirectory {
+				ve = append(ve, ValidationError{
+					Parameter: "directory",
+					Error:     "directory in the query does not match the directory in the URL",
+				})
+				err = errors.New("validation failed")
+			}
+
+			directoryName = query.Directory
+		}
+
+		pool, ok := pools.get(directoryName)
+		if !ok {
+			ve = append(ve, ValidationError{
+				Parameter: "directory",
+				Error:     fmt.Sprintf("directory '%s' does not exist", directoryName),
+			})
+			err = errors.New("validation failed")
+
+			// Avoid creating metrics for directories which don't exist
+			directoryName = ""
+		}
+
+		if ok {
+			base, baseErr := parseDN(query.Base)
+			if baseErr == nil && !pool.directory.withinNamingContexts(base) {
+				ve = append(ve, ValidationError{
+					Parameter: "base",
+					Error:     fmt.Sprintf("base MUST be within one of the naming contexts of directory '%s': %s", directoryName, strings.Join(pool.directory.NamingContexts, "; ")),
+				})
+				err = errors.New("validation failed")
+			}
+		}
+		// The cursor is checked last, as the connection it holds would otherwise need to be given back if anything else was invalid
+		fingerprint := queryFingerprint(directoryName, query)
+
+		var resumed *cursor
+		if err == nil && query.Cursor != "" {
+			resumed, err = pool.resumeCursor(query.Cursor, fingerprint)
+			if err != nil {
+				ve = append(ve, ValidationError{
+					Parameter: "cursor",
+					Error:     err.Error(),
+				})
+			}
+		}
+
 		if err != nil {
 			json, err := json.Marshal(ve)
 			if err != nil {
-				queryError.WithLabelValues("validate", strconv.Itoa(http.StatusInternalServerError), clientIP).Inc()
+				queryError.WithLabelValues(directoryName, "validate", strconv.Itoa(http.StatusInternalServerError), client).Inc()
 
 				logger.WithFields(logrus.Fields{
 					"trace_id":  traceID,
 					"client_ip": clientIP,
+					"client":    client,
 					"function":  "search",
 					"error":     err,
 				}).Error("unable to encode errors from validation process")
@@ -146,6 +192,7 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 			logger.WithFields(logrus.Fields{
 				"trace_id":          traceID,
 				"client_ip":         clientIP,
+				"client":            client,
 				"function":          "search",
 				"validation errors": json,
 			}).Error("error(s) when validating incoming query")
@@ -154,11 +201,20 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(json)
 
-			queryError.WithLabelValues("validate", strconv.Itoa(http.StatusBadRequest), clientIP).Inc()
+			queryError.WithLabelValues(directoryName, "validate", strconv.Itoa(http.StatusBadRequest), client).Inc()
 
 			return
 		}
 
+		logger.WithFields(logrus.Fields{
+			"trace_id":  traceID,
+			"client_ip": clientIP,
+			"client":    client,
+			"directory": directoryName,
+			"function":  "search",
+			"filter":    normaliseFilter(query.Filter),
+		}).Debug("Search directory")
+
 		// The ldap package defines the scopes as int, so we need to create a mapping between the string representation we're allowing
 		// consumers of this service to send, and the ldap package constants.
 		scopes := make(map[string]int)
@@ -171,28 +227,168 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 			scopes[query.Scope],
 			ldap.NeverDerefAliases,
 			0,
-			0,
+			query.TimeLimit,
 			false,
 			query.Filter,
 			query.Attributes,
 			nil,
 		)
 
-		var pageSize uint32
-		pageSize = 10000
-		res, err := ldapConn.SearchWithPaging(searchRequest, pageSize)
-		if err != nil {
+		var ldapConn *pooledConn
+		if resumed != nil {
+			ldapConn = resumed.conn
+		} else {
+			ldapConn, err = pool.get(r.Context())
+			if err != nil {
+				queryError.WithLabelValues(directoryName, "bind", strconv.Itoa(http.StatusInternalServerError), client).Inc()
+
+				logger.WithFields(logrus.Fields{
+					"trace_id":  traceID,
+					"client_ip": clientIP,
+					"client":    client,
+					"directory": directoryName,
+					"function":  "search",
+					"error":     err,
+				}).Error("unable to bind to directory")
+
+				APIResponse.Message = "unable to bind to directory"
+				APIResponse.Error = err.Error()
+				APIResponse.Send(http.StatusInternalServerError, w)
+
+				return
+			}
+		}
+
+		// Attribute names aren't checked by the directory, so a misspelt attribute just comes back empty; warn about any the schema doesn't know about
+		if pool.directory.ValidateAttributes && resumed == nil {
+			s, err := pool.schema(ldapConn)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"trace_id":  traceID,
+					"client_ip": clientIP,
+					"client":    client,
+					"directory": directoryName,
+					"function":  "search",
+					"error":     err,
+				}).Warn("unable to read schema; attributes have not been checked")
+			} else {
+				APIResponse.Warnings = append(APIResponse.Warnings, s.unknownAttributes(query)...)
+			}
+		}
+
+		// If the consumer hasn't asked for paging, every page is read from the directory before responding.
+		// Otherwise a single page is returned, along with a cursor to fetch the next one.
+		// A virtual list view cannot be combined with paging, so the window is read in one go.
+		pageSize := maxPageSize
+		if query.PageSize > 0 {
+			pageSize = query.PageSize
+		}
+
+		if query.VLV != nil {
+			pageSize = 0
+		}
+
+		// Sorting is left to the directory if it supports the server side sort control; otherwise the service sorts the results itself.
+		// The directory can also refuse to sort the results, e.g. if there is no ordering rule for the attribute, in which case we find out with the first page.
+		// A virtual list view relies on the directory sorting the results, so there is no fallback if it can't.
+		sortInService := false
+		if len(query.Sort) > 0 {
+			dse, err := pool.rootDSE(ldapConn)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"trace_id":  traceID,
+					"client_ip": clientIP,
+					"client":    client,
+					"directory": directoryName,
+					"function":  "search",
+					"error":     err,
+				}).Warn("unable to check directory support for server side sorting; sorting results in the service")
+			}
+
+			if query.VLV != nil && (err != nil || !dse.supportsControl(controlTypeServerSideSort) || !dse.supportsControl(controlTypeVLV)) {
+				pool.put(ldapConn, nil)
+
+				queryError.WithLabelValues(directoryName, "search", strconv.Itoa(http.StatusBadRequest), client).Inc()
+
+				logger.WithFields(logrus.Fields{
+					"trace_id":  traceID,
+					"client_ip": clientIP,
+					"client":    client,
+					"directory": directoryName,
+					"function":  "search",
+				}).Error("directory does not support virtual list views")
+
+				APIResponse.Message = fmt.Sprintf("directory '%s' does not support virtual list views", directoryName)
+				APIResponse.Send(http.StatusBadRequest, w)
+
+				return
+			}
+
+			if err != nil || !dse.supportsControl(controlTypeServerSideSort) {
+				sortInService = true
+				APIResponse.Warnings = append(APIResponse.Warnings, "the directory does not support server side sorting, so the results were sorted by the service")
+			} else {
+				searchRequest.Controls = append(searchRequest.Controls, newControlServerSideSort(query.Sort))
+			}
+		}
+
+		if query.VLV != nil {
+			searchRequest.Controls = append(searchRequest.Controls, newControlVLV(*query.VLV))
+		}
+
+		search := newPagedSearch(ldapConn, searchRequest, pageSize, query.SizeLimit)
+		if resumed != nil {
+			search.paging.SetCookie(resumed.cookie)
+			search.returned = resumed.returned
+		}
+
+		// Entries are either streamed to the consumer page by page, or collected and sent in a single JSON response once the search is complete
+		out := newResultWriter(w, r, query, pool.directory)
+
+		var objects []ldapObject
+
+		emit := func(entries []*ldap.Entry) error {
+			if out != nil {
+				return out.writeEntries(entries)
+			}
+
+			// We need to loop over the entries and pull out any attributes requested by the consumer
+			for _, entry := range entries {
+				objects = append(objects, newLDAPObject(entry, query, pool.directory))
+			}
+
+			return nil
+		}
+
+		streamFailed := func(err error) {
+			search.abandon()
+			pool.put(ldapConn, nil)
+
+			logger.WithFields(logrus.Fields{
+				"trace_id":  traceID,
+				"client_ip": clientIP,
+				"client":    client,
+				"directory": directoryName,
+				"function":  "search",
+				"error":     err,
+			}).Warn("unable to stream results; abandoning search")
+		}
+
+		// searchFailed reports a failed search to the consumer; the connection MUST already have been given back to the pool
+		searchFailed := func(err error) {
 			err2 := err
 			// Let's ensure we return a friendly error message if available
 			if err, ok := err.(*ldap.Error); ok {
 				err2 = errors.New(ldap.LDAPResultCodeMap[err.ResultCode])
 			}
 
-			queryError.WithLabelValues("search", strconv.Itoa(http.StatusInternalServerError), clientIP).Inc()
+			queryError.WithLabelValues(directoryName, "search", strconv.Itoa(http.StatusInternalServerError), client).Inc()
 
 			logger.WithFields(logrus.Fields{
 				"trace_id":   traceID,
 				"client_ip":  clientIP,
+				"client":     client,
+				"directory":  directoryName,
 				"function":   "search",
 				"error":      err2,
 				"filter":     query.Filter,
@@ -201,43 +397,144 @@ func search(directory directory, logger *logrus.Entry) http.HandlerFunc {
 				"base":       query.Base,
 			}).Error("unable to search LDAP")
 
+			// If nothing has been streamed yet, the failure can be reported with the normal response and status
+			if out != nil && out.started() {
+				out.finish(streamSummary{
+					TraceID: traceID,
+					Message: "unable to search LDAP",
+					Error:   err2.Error(),
+				})
+
+				return
+			}
+
 			APIResponse.Message = "unable to search LDAP"
 			APIResponse.Error = err2.Error()
 			APIResponse.Send(http.StatusInternalServerError, w)
-
-			return
 		}
 
-		var objects []ldapObject
+		// Entries which need to be sorted by the service are held back until every page for this request has been read
+		var unsorted []*ldap.Entry
 
-		// The response object contains a slice of returned entries.
-		// We need to loop over them and pull out any attributes requested by the consumer.
-		for _, entry := range res.Entries {
-			var object ldapObject
+		for !search.done {
+			entries, err := search.next()
+			if err != nil {
+				pool.put(ldapConn, err)
+				searchFailed(err)
 
-			object.Attributes = make(map[string]string)
+				return
+			}
 
-			for _, a := range query.Attributes {
-				if strings.ToLower(a) == "distinguishedname" {
-					object.DistinguishedName = entry.DN
-					continue
+			if query.VLV != nil {
+				vlv, err := readVLVResponse(search.controls)
+				if err != nil {
+					pool.put(ldapConn, nil)
+					searchFailed(err)
+
+					return
 				}
 
-				if strings.ToLower(a) == "memberof" {
-					object.Attributes[a] = strings.Join(entry.GetAttributeValues(a), "|")
-					continue
+				APIResponse.VLV = &vlv
+			}
+
+			// Large multi-valued attributes may only have been partly returned, so fetch the rest of their values before the entries are used
+			err = retrieveRanges(ldapConn, entries, query.Attributes)
+			if err != nil {
+				if !search.done {
+					search.abandon()
 				}
+				// The error is wrapped with the attribute being retrieved, which would stop it being recognised as an LDAP error
+				pool.put(ldapConn, errors.Cause(err))
+				searchFailed(errors.Cause(err))
+
+				return
+			}
 
-				object.Attributes[a] = entry.GetAttributeValue(a)
+			if len(query.Sort) > 0 && !sortInService {
+				if result, ok := serverSideSortResult(search.controls); ok && result != ldap.LDAPResultSuccess {
+					sortInService = true
+					APIResponse.Warnings = append(APIResponse.Warnings, fmt.Sprintf("the directory was unable to sort the results (%s), so they were sorted by the service", ldap.LDAPResultCodeMap[result]))
+				}
 			}
 
-			objects = append(objects, object)
+			if sortInService {
+				unsorted = append(unsorted, entries...)
+			} else {
+				err = emit(entries)
+				if err != nil {
+					streamFailed(err)
+					return
+				}
+			}
+
+			if query.PageSize > 0 {
+				break
+			}
+		}
+
+		if sortInService {
+			if query.PageSize > 0 {
+				APIResponse.Warnings = append(APIResponse.Warnings, "results sorted by the service are only sorted within each page")
+			}
+
+			sortEntries(unsorted, query.Sort)
+
+			err = emit(unsorted)
+			if err != nil {
+				streamFailed(err)
+				return
+			}
+		}
+
+		// cursorLost is set if there were more pages, but no cursor could be held to fetch them
+		cursorLost := false
+
+		if search.done {
+			pool.put(ldapConn, nil)
+		} else {
+			APIResponse.Cursor, err = pool.holdCursor(ldapConn, search.paging.Cookie, fingerprint, search.returned)
+			if err != nil {
+				search.abandon()
+				pool.put(ldapConn, nil)
+
+				logger.WithFields(logrus.Fields{
+					"trace_id":  traceID,
+					"client_ip": clientIP,
+					"client":    client,
+					"directory": directoryName,
+					"function":  "search",
+					"error":     err,
+				}).Error("unable to hold cursor for next page; returning a partial result")
+
+				cursorLost = true
+			}
+		}
+
+		if search.truncated {
+			APIResponse.Truncated = true
+			APIResponse.Message = "the size or time limit was reached before all results were returned"
+		} else if cursorLost {
+			APIResponse.Truncated = true
+			APIResponse.Message = "the remaining pages could not be kept for a cursor, so not all results were returned; retry the query"
 		}
 
 		duration := time.Since(start)
-		requestDuration.WithLabelValues(strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
+		requestDuration.WithLabelValues(directoryName, strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
+
+		if out != nil {
+			out.finish(streamSummary{
+				TraceID:   traceID,
+				Cursor:    APIResponse.Cursor,
+				Truncated: APIResponse.Truncated,
+				Warnings:  APIResponse.Warnings,
+				VLV:       APIResponse.VLV,
+				Message:   APIResponse.Message,
+			})
+
+			return
+		}
 
-		if len(objects) == 0 {
+		if len(objects) == 0 && APIResponse.Cursor == "" {
 			APIResponse.Send(http.StatusNotFound, w)
 			return
 		}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// Server side sort request and response controls; see RFC 2891
+const (
+	controlTypeServerSideSort         = "1.2.840.113556.1.4.473"
+	controlTypeServerSideSortResponse = "1.2.840.113556.1.4.474"
+)
+
+// sortKey is one of the attributes the results are sorted by.
+// Direction is either asc, the default, or desc; MatchingRule is the name or OID of the ordering rule to use, if not the default for the attribute.
+type sortKey struct {
+	Attribute    string `json:"attribute"`
+	Direction    string `json:"direction"`
+	MatchingRule string `json:"matchingRule"`
+}
+
+func (k sortKey) descending() bool {
+	return strings.EqualFold(k.Direction, "desc")
+}
+
+// controlServerSideSort is the server side sort request control, which the ldap package doesn't provide
+type controlServerSideSort struct {
+	keys []sortKey
+}
+
+func newControlServerSideSort(keys []sortKey) *controlServerSideSort {
+	return &controlServerSideSort{keys: keys}
+}
+
+// GetControlType returns the OID
+func (c *controlServerSideSort) GetControlType() string {
+	return controlTypeServerSideSort
+}
+
+// Encode returns the BER encoding of the control.
+// It is not marked as critical, so that a directory which is unable to sort the results still returns them; see serverSideSortResult.
+//
+//	SortKeyList ::= SEQUENCE OF SEQUENCE {
+//	    attributeType   AttributeDescription,
+//	    orderingRule    [0] MatchingRuleId OPTIONAL,
+//	    reverseOrder    [1] BOOLEAN DEFAULT FALSE }
+func (c *controlServerSideSort) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlTypeServerSideSort, "Control Type (Server Side Sort)"))
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Server Side Sort)")
+	keys := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeyList")
+
+	for _, k := range c.keys {
+		key := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKey")
+		key.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k.Attribute, "attributeType"))
+
+		if k.MatchingRule != "" {
+			key.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, k.MatchingRule, "orderingRule"))
+		}
+
+		if k.descending() {
+			key.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, true, "reverseOrder"))
+		}
+
+		keys.AppendChild(key)
+	}
+
+	value.AppendChild(keys)
+	packet.AppendChild(value)
+
+	return packet
+}
+
+// String returns a human-readable description
+func (c *controlServerSideSort) String() string {
+	var keys []string
+	for _, k := range c.keys {
+		keys = append(keys, fmt.Sprintf("%s %s %s", k.Attribute, k.Direction, k.MatchingRule))
+	}
+
+	return fmt.Sprintf("Control Type: Server Side Sort (%q)  Keys: %q", controlTypeServerSideSort, keys)
+}
+
+// serverSideSortResult reads the result code from the server side sort response control.
+// It returns false if the directory didn't send the control.
+//
+//	SortResult ::= SEQUENCE {
+//	    sortResult      ENUMERATED,
+//	    attributeType   [0] AttributeDescription OPTIONAL }
+func serverSideSortResult(controls []ldap.Control) (uint16, bool) {
+	control, ok := ldap.FindControl(controls, controlTypeServerSideSortResponse).(*ldap.ControlString)
+	if !ok {
+		return 0, false
+	}
+
+	packet, err := ber.DecodePacketErr([]byte(control.ControlValue))
+	if err != nil || len(packet.Children) == 0 {
+		return 0, false
+	}
+
+	result, ok := packet.Children[0].Value.(int64)
+	if !ok {
+		return 0, false
+	}
+
+	return uint16(result), true
+}
+
+// sortEntries sorts the entries in the service, for directories which are unable to do it themselves.
+// As in RFC 2891, entries without a value for a sort attribute sort after those which have one, and for multi-valued attributes
+// the lowest value is used when sorting in ascending order and the highest in descending order.
+func sortEntries(entries []*ldap.Entry, keys []sortKey) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, k := range keys {
+			c := k.compareEntries(entries[i], entries[j])
+			if c != 0 {
+				return c < 0
+			}
+		}
+
+		return false
+	})
+}
+
+// compareEntries orders two entries by the sort key, taking account of its direction.
+// Entries without a value always come last, whichever direction is used.
+func (k sortKey) compareEntries(a, b *ldap.Entry) int {
+	va, okA := k.value(a)
+	vb, okB := k.value(b)
+
+	switch {
+	case !okA && !okB:
+		return 0
+	case !okA:
+		return 1
+	case !okB:
+		return -1
+	}
+
+	if k.descending() {
+		return k.compare(vb, va)
+	}
+
+	return k.compare(va, vb)
+}
+
+func (k sortKey) value(entry *ldap.Entry) (string, bool) {
+	attr := findAttribute(entry, k.Attribute)
+	if attr == nil || len(attr.Values) == 0 {
+		return "", false
+	}
+
+	v := attr.Values[0]
+	for _, other := range attr.Values[1:] {
+		c := k.compare(other, v)
+		if (c < 0 && !k.descending()) || (c > 0 && k.descending()) {
+			v = other
+		}
+	}
+
+	return v, true
+}
+
+// compare orders two values using the matching rule of the sort key.
+// Only the common ordering rules are understood; anything else is compared as case insensitive strings, which is the usual default.
+func (k sortKey) compare(a, b string) int {
+	switch strings.ToLower(k.MatchingRule) {
+	case "integerorderingmatch", "2.5.13.15":
+		x, errX := strconv.ParseInt(a, 10, 64)
+		y, errY := strconv.ParseInt(b, 10, 64)
+		if errX == nil && errY == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+
+			return 0
+		}
+	case "caseexactorderingmatch", "2.5.13.6":
+		return strings.Compare(a, b)
+	}
+
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// decodeControlValue decodes a control the way the directory would, returning the type and the decoded value
+func decodeControlValue(t *testing.T, c ldap.Control) (string, *ber.Packet) {
+	t.Helper()
+
+	packet, err := ber.DecodePacketErr(c.Encode().Bytes())
+	if err != nil {
+		t.Fatalf("unable to decode control: %v", err)
+	}
+
+	if len(packet.Children) != 2 {
+		t.Fatalf("expected the control type and value, got %d children", len(packet.Children))
+	}
+
+	value, err := ber.DecodePacketErr(packet.Children[1].Data.Bytes())
+	if err != nil {
+		t.Fatalf("unable to decode control value: %v", err)
+	}
+
+	return packet.Children[0].Value.(string), value
+}
+
+func TestControlServerSideSortEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []sortKey
+		want [][]string
+	}{
+		{"ascending", []sortKey{{Attribute: "sn"}}, [][]string{{"sn"}}},
+		{"asc is the default", []sortKey{{Attribute: "sn", Direction: "asc"}}, [][]string{{"sn"}}},
+		{"descending", []sortKey{{Attribute: "sn", Direction: "desc"}}, [][]string{{"sn", "reverse"}}},
+		{"DESC", []sortKey{{Attribute: "sn", Direction: "DESC"}}, [][]string{{"sn", "reverse"}}},
+		{"ordering rule", []sortKey{{Attribute: "uSNChanged", MatchingRule: "2.5.13.15"}}, [][]string{{"uSNChanged", "rule 2.5.13.15"}}},
+		{"ordering rule and descending", []sortKey{{Attribute: "uSNChanged", Direction: "desc", MatchingRule: "integerOrderingMatch"}}, [][]string{{"uSNChanged", "rule integerOrderingMatch", "reverse"}}},
+		{"keys keep their order", []sortKey{{Attribute: "sn"}, {Attribute: "givenName", Direction: "desc"}, {Attribute: "cn"}}, [][]string{{"sn"}, {"givenName", "reverse"}, {"cn"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controlType, value := decodeControlValue(t, newControlServerSideSort(tt.keys))
+
+			if controlType != controlTypeServerSideSort {
+				t.Errorf("expected control type %q, got %q", controlTypeServerSideSort, controlType)
+			}
+
+			var got [][]string
+			for _, key := range value.Children {
+				k := []string{key.Children[0].Value.(string)}
+
+				for _, c := range key.Children[1:] {
+					if c.ClassType != ber.ClassContext {
+						t.Fatalf("expected a context specific tag, got class %d", c.ClassType)
+					}
+
+					switch c.Tag {
+					case 0:
+						k = append(k, "rule "+c.Data.String())
+					case 1:
+						if c.Data.Len() != 1 || c.Data.Bytes()[0] == 0 {
+							t.Errorf("expected reverseOrder to be encoded as TRUE, got %x", c.Data.Bytes())
+						}
+
+						k = append(k, "reverse")
+					default:
+						t.Fatalf("unexpected tag %d in sort key", c.Tag)
+					}
+				}
+
+				got = append(got, k)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// sortResponseControl builds the server side sort response control the directory would send
+func sortResponseControl(result int64, attribute string) *ldap.ControlString {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortResult")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, result, "sortResult"))
+
+	if attribute != "" {
+		value.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, attribute, "attributeType"))
+	}
+
+	return &ldap.ControlString{ControlType: controlTypeServerSideSortResponse, ControlValue: string(value.Bytes())}
+}
+
+func TestServerSideSortResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		controls []ldap.Control
+		result   uint16
+		ok       bool
+	}{
+		{"success", []ldap.Control{sortResponseControl(0, "")}, 0, true},
+		{"unwilling to perform", []ldap.Control{sortResponseControl(53, "")}, 53, true},
+		{"no such attribute", []ldap.Control{sortResponseControl(16, "sn")}, 16, true},
+		{"alongside other controls", []ldap.Control{ldap.NewControlPaging(100), sortResponseControl(0, "")}, 0, true},
+		{"no controls", nil, 0, false},
+		{"no sort control", []ldap.Control{ldap.NewControlPaging(100)}, 0, false},
+		{"empty value", []ldap.Control{&ldap.ControlString{ControlType: controlTypeServerSideSortResponse}}, 0, false},
+		{"malformed value", []ldap.Control{&ldap.ControlString{ControlType: controlTypeServerSideSortResponse, ControlValue: "\x30\x05\x0a"}}, 0, false},
+		{"empty sequence", []ldap.Control{&ldap.ControlString{ControlType: controlTypeServerSideSortResponse, ControlValue: "\x30\x00"}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := serverSideSortResult(tt.controls)
+			if result != tt.result || ok != tt.ok {
+				t.Errorf("expected (%d, %v), got (%d, %v)", tt.result, tt.ok, result, ok)
+			}
+		})
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	entries := func() []*ldap.Entry {
+		return []*ldap.Entry{
+			ldap.NewEntry("cn=a", map[string][]string{"sn": {"skywalker"}, "givenName": {"Luke"}, "uSNChanged": {"100"}, "mail": {"z@corp.local", "a@corp.local"}}),
+			ldap.NewEntry("cn=b", map[string][]string{"sn": {"Organa"}, "givenName": {"Leia"}, "uSNChanged": {"20"}}),
+			ldap.NewEntry("cn=c", map[string][]string{"sn": {"Skywalker"}, "givenName": {"Anakin"}, "uSNChanged": {"3"}, "mail": {"m@corp.local"}}),
+			ldap.NewEntry("cn=d", map[string][]string{"givenName": {"Han"}}),
+		}
+	}
+
+	tests := []struct {
+		name string
+		keys []sortKey
+		want []string
+	}{
+		{"case insensitive by default", []sortKey{{Attribute: "sn"}}, []string{"cn=b", "cn=a", "cn=c", "cn=d"}},
+		{"missing values sort last when descending", []sortKey{{Attribute: "sn", Direction: "desc"}}, []string{"cn=a", "cn=c", "cn=b", "cn=d"}},
+		{"case exact", []sortKey{{Attribute: "sn", MatchingRule: "caseExactOrderingMatch"}}, []string{"cn=b", "cn=c", "cn=a", "cn=d"}},
+		{"second key breaks ties", []sortKey{{Attribute: "sn"}, {Attribute: "givenName"}}, []string{"cn=b", "cn=c", "cn=a", "cn=d"}},
+		{"strings", []sortKey{{Attribute: "uSNChanged"}}, []string{"cn=a", "cn=b", "cn=c", "cn=d"}},
+		{"integers", []sortKey{{Attribute: "uSNChanged", MatchingRule: "integerOrderingMatch"}}, []string{"cn=c", "cn=b", "cn=a", "cn=d"}},
+		{"integers by OID", []sortKey{{Attribute: "uSNChanged", MatchingRule: "2.5.13.15", Direction: "desc"}}, []string{"cn=a", "cn=b", "cn=c", "cn=d"}},
+		{"lowest value of a multi-valued attribute ascending", []sortKey{{Attribute: "mail"}}, []string{"cn=a", "cn=c", "cn=b", "cn=d"}},
+		{"highest value of a multi-valued attribute descending", []sortKey{{Attribute: "mail", Direction: "desc"}}, []string{"cn=a", "cn=c", "cn=b", "cn=d"}},
+		{"attribute names are case insensitive", []sortKey{{Attribute: "GIVENNAME"}}, []string{"cn=c", "cn=d", "cn=b", "cn=a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := entries()
+			sortEntries(e, tt.keys)
+
+			var got []string
+			for _, entry := range e {
+				got = append(got, entry.DN)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
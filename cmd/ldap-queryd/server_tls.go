@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/justinas/alice"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// newServerTLSConfig validates the TLS settings for the API server and builds the TLS configuration it listens with.
+// A nil config is returned if HTTPS has not been enabled, in which case the API is served over plain HTTP.
+func newServerTLSConfig(s server) (*tls.Config, error) {
+	if s.TLSCert == "" && s.TLSKey == "" {
+		if s.TLSClientCA != "" || len(s.TLSClientSubjects) > 0 {
+			return nil, errors.New("client certificate settings have been defined but tls_cert and tls_key have not")
+		}
+
+		return nil, nil
+	}
+
+	if s.TLSCert == "" || s.TLSKey == "" {
+		return nil, errors.New("tls_cert and tls_key are both required to serve HTTPS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.TLSCert, s.TLSKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load TLS certificate and key")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(s.TLSClientSubjects) > 0 && s.TLSClientCA == "" {
+		return nil, errors.New("tls_client_ca is required to restrict the client certificate subjects")
+	}
+
+	// Client certificates are only requested if there is a CA to verify them against.
+	// They are verified if given, but not required by the handshake, so that /status and /metrics stay open to health checks and scrapes;
+	// the query endpoints require them; see checkClientCertificate.
+	if s.TLSClientCA != "" {
+		pem, err := os.ReadFile(s.TLSClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read TLS client CA certificate bundle")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in %s", s.TLSClientCA)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// checkClientCertificate ensures that the request was made with a client certificate, and identifies the caller from it.
+// Any certificate given has already been verified against the client CA during the TLS handshake.
+// If any subjects are configured, only certificates matching one of them are let through.
+// The caller name is stored in the request context; an API key or JWT sent with the request takes precedence over it.
+// If client certificates are not required, every request is let through.
+func checkClientCertificate(tlsConfig *tls.Config, subjects []string, logger *logrus.Entry) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		if tlsConfig == nil || tlsConfig.ClientCAs == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+				logger.WithFields(logrus.Fields{
+					"client_ip": r.Context().Value(clientIPCtxKey),
+					"function":  "checkClientCertificate",
+				}).Warn("request does not include a client certificate")
+
+				APIResponse := Response{
+					Message: "a client certificate is required",
+				}
+
+				APIResponse.Send(http.StatusUnauthorized, w)
+
+				return
+			}
+
+			cert := r.TLS.PeerCertificates[0]
+
+			name, ok := certificateName(cert, subjects)
+			if !ok {
+				logger.WithFields(logrus.Fields{
+					"client_ip": r.Context().Value(clientIPCtxKey),
+					"function":  "checkClientCertificate",
+					"subject":   cert.Subject.String(),
+				}).Warn("client certificate subject is not allowed")
+
+				msg := fmt.Sprintf("client certificate %q is not allowed to query; check the config", cert.Subject.String())
+				APIResponse := Response{
+					Message: msg,
+				}
+
+				APIResponse.Send(http.StatusForbidden, w)
+
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), clientCtxKey, name)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// certificateName maps a client certificate to the name of the caller.
+//
+// If subjects are configured, the name is the first subject which the certificate matches; a subject matches if it is the same as
+// the full subject DN, the common name, or one of the DNS, email or URI SANs of the certificate.
+// Otherwise the name is the first DNS, email or URI SAN, falling back to the common name and then the full subject DN.
+func certificateName(cert *x509.Certificate, subjects []string) (string, bool) {
+	var names []string
+
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.Subject.String())
+
+	if len(subjects) == 0 {
+		return names[0], true
+	}
+
+	for _, s := range subjects {
+		for _, n := range names {
+			if strings.EqualFold(s, n) {
+				return s, true
+			}
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+// resultWriter sends the results of a search to the consumer as they are read from the directory, rather than buffering them all first.
+// Nothing is sent until the first page has been read, so that a search which fails straight away gets the normal JSON error response and status.
+// Once the first page has been written the HTTP status can no longer be changed, so the outcome of the search is reported by finish instead.
+type resultWriter interface {
+	// writeEntries is called with the entries from each page read from the directory.
+	// An error means the consumer can no longer be written to, and the search should be abandoned.
+	writeEntries(entries []*ldap.Entry) error
+
+	// finish is called once the search has completed, or failed after it started, with a summary of the outcome
+	finish(summary streamSummary) error
+
+	// started reports whether the HTTP status has been sent
+	started() bool
+}
+
+// streamSummary is the outcome of a streamed search
+type streamSummary struct {
+	TraceID   string     `json:"trace_id"`
+	Count     int        `json:"count"`
+	Cursor    string     `json:"cursor,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+	Warnings  []string   `json:"warnings,omitempty"`
+	VLV       *vlvResult `json:"vlv,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// The formats which search results can be returned in, chosen using the format parameter of the query or the Accept header
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatLDIF   = "ldif"
+)
+
+// formatMediaTypes lists the media types which can be used in the Accept header to choose a format, in order of preference
+var formatMediaTypes = []struct {
+	format    string
+	mediaType string
+}{
+	{formatNDJSON, "application/x-ndjson"},
+	{formatCSV, "text/csv"},
+	{formatLDIF, "text/x-ldif"},
+}
+
+// resultFormat works out which format the consumer wants the results in.
+// The format parameter takes precedence over stream, which takes precedence over the Accept header; JSON is the default.
+// Any parameters of the matching media type in the Accept header are also returned, e.g. header=absent for CSV.
+func resultFormat(r *http.Request, query Query) (string, map[string]string) {
+	if query.Format != "" {
+		return strings.ToLower(query.Format), nil
+	}
+
+	if query.Stream {
+		return formatNDJSON, nil
+	}
+
+	for _, f := range formatMediaTypes {
+		if params, ok := accepts(r, f.mediaType); ok {
+			return f.format, params
+		}
+	}
+
+	return formatJSON, nil
+}
+
+// newResultWriter returns the writer for the format, or nil if the results should be sent as a single JSON response
+func newResultWriter(w http.ResponseWriter, r *http.Request, query Query, directory directory) resultWriter {
+	format, params := resultFormat(r, query)
+
+	switch format {
+	case formatNDJSON:
+		return newNDJSONWriter(w, query, directory)
+	case formatCSV:
+		return newCSVWriter(w, query, directory, query.CSVHeader && params["header"] != "absent")
+	case formatLDIF:
+		return newLDIFWriter(w, query, directory)
+	}
+
+	return nil
+}
+
+// accepts checks whether the request lists the media type in its Accept header, returning any parameters given with it
+func accepts(r *http.Request, mediaType string) (map[string]string, bool) {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && strings.EqualFold(t, mediaType) {
+			return params, true
+		}
+	}
+
+	return nil, false
+}
+
+// Formats which have nowhere to put the outcome of the search, such as CSV, send it in these HTTP trailers instead
+const resultTrailers = "X-Trace-Id, X-Result-Count, X-Result-Cursor, X-Result-Truncated, X-Result-Warnings, X-Result-Target-Position, X-Result-Content-Count, X-Result-Error"
+
+// setResultTrailers sets the trailers announced in resultTrailers from the summary of the search
+func setResultTrailers(w http.ResponseWriter, summary streamSummary) {
+	w.Header().Set("X-Trace-Id", summary.TraceID)
+	w.Header().Set("X-Result-Count", strconv.Itoa(summary.Count))
+	w.Header().Set("X-Result-Cursor", summary.Cursor)
+	w.Header().Set("X-Result-Truncated", strconv.FormatBool(summary.Truncated))
+	w.Header().Set("X-Result-Warnings", strings.Join(summary.Warnings, "; "))
+	w.Header().Set("X-Result-Error", summary.Error)
+
+	if summary.VLV != nil {
+		w.Header().Set("X-Result-Target-Position", strconv.Itoa(summary.VLV.TargetPosition))
+		w.Header().Set("X-Result-Content-Count", strconv.Itoa(summary.VLV.ContentCount))
+	}
+}
+
+// flush sends anything which has been written so far to the consumer, if the ResponseWriter supports it
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ndjsonWriter writes each entry as a JSON object on its own line, in the same format as in the result of a normal search.
+// The last line is the summary, which can be told apart from the entries as it has a trace_id.
+type ndjsonWriter struct {
+	w         http.ResponseWriter
+	encoder   *json.Encoder
+	query     Query
+	directory directory
+	count     int
+	begun     bool
+}
+
+func newNDJSONWriter(w http.ResponseWriter, query Query, directory directory) *ndjsonWriter {
+	return &ndjsonWriter{
+		w:         w,
+		encoder:   json.NewEncoder(w),
+		query:     query,
+		directory: directory,
+	}
+}
+
+// begin sends the HTTP status, the first time anything is written
+func (n *ndjsonWriter) begin() {
+	if n.begun {
+		return
+	}
+	n.begun = true
+
+	n.w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	n.w.WriteHeader(http.StatusOK)
+}
+
+func (n *ndjsonWriter) started() bool {
+	return n.begun
+}
+
+func (n *ndjsonWriter) writeEntries(entries []*ldap.Entry) error {
+	n.begin()
+
+	for _, entry := range entries {
+		err := n.encoder.Encode(newLDAPObject(entry, n.query, n.directory))
+		if err != nil {
+			return err
+		}
+
+		n.count++
+	}
+
+	flush(n.w)
+
+	return nil
+}
+
+func (n *ndjsonWriter) finish(summary streamSummary) error {
+	n.begin()
+
+	summary.Count = n.count
+
+	err := n.encoder.Encode(summary)
+	if err != nil {
+		return err
+	}
+
+	flush(n.w)
+
+	return nil
+}
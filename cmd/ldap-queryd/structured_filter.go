@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// filterNode is one part of a structured filter; an object with a single operator as the key.
+//
+//	{"and": [filter, ...]}, {"or": [filter, ...]}, {"not": filter}
+//	{"present": "attribute"}
+//	{"eq": ["attribute", "value"]}, {"ne": [...]}, {"approx": [...]}, {"gte": [...]}, {"lte": [...]}
+//	{"startsWith": ["attribute", "value"]}, {"endsWith": [...]}, {"contains": [...]}
+//
+// Values are always escaped, so any wildcards or brackets in them are matched literally.
+type filterNode map[string]json.RawMessage
+
+// comparisons maps the operators which compare an attribute with a value to the format of the filter they produce
+var comparisons = map[string]string{
+	"eq":         "(%s=%s)",
+	"ne":         "(!(%s=%s))",
+	"approx":     "(%s~=%s)",
+	"gte":        "(%s>=%s)",
+	"lte":        "(%s<=%s)",
+	"startsWith": "(%s=%s*)",
+	"endsWith":   "(%s=*%s)",
+	"contains":   "(%s=*%s*)",
+}
+
+// build translates the structured filter into an RFC 4515 filter string.
+// The path is used to show where the problem is in any error returned, e.g. structuredFilter.and[1].eq
+func (n filterNode) build(path string) (string, error) {
+	if len(n) != 1 {
+		return "", fmt.Errorf("%s MUST have exactly one operator", path)
+	}
+
+	for op, raw := range n {
+		path := fmt.Sprintf("%s.%s", path, op)
+
+		switch op {
+		case "and", "or":
+			var children []filterNode
+
+			err := json.Unmarshal(raw, &children)
+			if err != nil {
+				return "", fmt.Errorf("%s MUST be an array of filters", path)
+			}
+
+			if len(children) == 0 {
+				return "", fmt.Errorf("%s MUST contain at least one filter", path)
+			}
+
+			var filter strings.Builder
+			filter.WriteString("(")
+			if op == "and" {
+				filter.WriteString("&")
+			} else {
+				filter.WriteString("|")
+			}
+
+			for i, child := range children {
+				f, err := child.build(fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return "", err
+				}
+
+				filter.WriteString(f)
+			}
+
+			filter.WriteString(")")
+
+			return filter.String(), nil
+
+		case "not":
+			var child filterNode
+
+			err := json.Unmarshal(raw, &child)
+			if err != nil || child == nil {
+				return "", fmt.Errorf("%s MUST be a filter", path)
+			}
+
+			f, err := child.build(path)
+			if err != nil {
+				return "", err
+			}
+
+			return "(!" + f + ")", nil
+
+		case "present":
+			var attribute string
+
+			err := json.Unmarshal(raw, &attribute)
+			if err != nil {
+				return "", fmt.Errorf("%s MUST be an attribute name", path)
+			}
+
+			err = validateFilterAttribute(attribute)
+			if err != nil {
+				return "", errors.Wrap(err, path)
+			}
+
+			return fmt.Sprintf("(%s=*)", attribute), nil
+		}
+
+		format, ok := comparisons[op]
+		if !ok {
+			return "", fmt.Errorf("%s is not a known operator", path)
+		}
+
+		var pair []string
+
+		err := json.Unmarshal(raw, &pair)
+		if err != nil || len(pair) != 2 {
+			return "", fmt.Errorf("%s MUST be an array of an attribute name and a value", path)
+		}
+
+		err = validateFilterAttribute(pair[0])
+		if err != nil {
+			return "", errors.Wrap(err, path)
+		}
+
+		if pair[1] == "" && op != "eq" && op != "ne" {
+			return "", fmt.Errorf("%s MUST have a value", path)
+		}
+
+		return fmt.Sprintf(format, pair[0], ldap.EscapeFilter(pair[1])), nil
+	}
+
+	return "", nil
+}
+
+func validateFilterAttribute(attribute string) error {
+	if !validAttributeDescription.MatchString(attribute) {
+		return fmt.Errorf("%q is not a valid attribute name", attribute)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func buildStructuredFilter(t *testing.T, s string) (string, error) {
+	t.Helper()
+
+	var n filterNode
+
+	err := json.Unmarshal([]byte(s), &n)
+	if err != nil {
+		t.Fatalf("unable to unmarshal structured filter %s: %v", s, err)
+	}
+
+	return n.build("structuredFilter")
+}
+
+func TestStructuredFilterBuild(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"eq", `{"eq": ["cn", "user01"]}`, "(cn=user01)"},
+		{"eq with an empty value", `{"eq": ["description", ""]}`, "(description=)"},
+		{"ne", `{"ne": ["cn", "user01"]}`, "(!(cn=user01))"},
+		{"approx", `{"approx": ["sn", "smith"]}`, "(sn~=smith)"},
+		{"gte", `{"gte": ["uSNChanged", "1000"]}`, "(uSNChanged>=1000)"},
+		{"lte", `{"lte": ["uSNChanged", "1000"]}`, "(uSNChanged<=1000)"},
+		{"startsWith", `{"startsWith": ["sn", "Sky"]}`, "(sn=Sky*)"},
+		{"endsWith", `{"endsWith": ["mail", "@corp.local"]}`, "(mail=*@corp.local)"},
+		{"contains", `{"contains": ["displayName", "walker"]}`, "(displayName=*walker*)"},
+		{"present", `{"present": "mail"}`, "(mail=*)"},
+		{"attribute with options", `{"eq": ["userCertificate;binary", "x"]}`, "(userCertificate;binary=x)"},
+		{"OID attribute", `{"eq": ["2.5.4.3", "user01"]}`, "(2.5.4.3=user01)"},
+		{"and", `{"and": [{"eq": ["objectClass", "user"]}, {"startsWith": ["sn", "Sky"]}]}`, "(&(objectClass=user)(sn=Sky*))"},
+		{"or with a single filter", `{"or": [{"present": "mail"}]}`, "(|(mail=*))"},
+		{"not", `{"not": {"present": "mail"}}`, "(!(mail=*))"},
+		{
+			"nested",
+			`{"and": [{"eq": ["objectClass", "group"]}, {"or": [{"eq": ["cn", "a"]}, {"not": {"eq": ["cn", "b"]}}]}]}`,
+			"(&(objectClass=group)(|(cn=a)(!(cn=b))))",
+		},
+
+		// Values are always escaped, so that user input can't change the structure of the filter
+		{"brackets are escaped", `{"eq": ["cn", "(admins)"]}`, `(cn=\28admins\29)`},
+		{"wildcards are escaped", `{"eq": ["cn", "*"]}`, `(cn=\2a)`},
+		{"wildcards are escaped in substrings", `{"startsWith": ["cn", "a*b"]}`, `(cn=a\2ab*)`},
+		{"backslashes are escaped", `{"eq": ["cn", "a\\b"]}`, `(cn=a\5cb)`},
+		{"NUL is escaped", `{"eq": ["cn", "a\u0000b"]}`, `(cn=a\00b)`},
+		{"non-ASCII is escaped", `{"eq": ["sn", "Ångström"]}`, `(sn=\c3\85ngstr\c3\b6m)`},
+		{"injection attempt", `{"eq": ["uid", "*)(uid=*))(|(uid=*"]}`, `(uid=\2a\29\28uid=\2a\29\29\28|\28uid=\2a)`},
+		{"injection attempt in contains", `{"contains": ["cn", "x)(objectClass=*"]}`, `(cn=*x\29\28objectClass=\2a*)`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildStructuredFilter(t, tt.json)
+			if err != nil {
+				t.Fatalf("expected %q, got %v", tt.want, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+
+			// Every filter built must be valid, so that it is sent to the directory as it is
+			err = validateFilter(got)
+			if err != nil {
+				t.Errorf("built filter %q is not valid: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestStructuredFilterBuildErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  string
+	}{
+		{"no operator", `{}`, "structuredFilter MUST have exactly one operator"},
+		{"two operators", `{"eq": ["cn", "a"], "present": "mail"}`, "structuredFilter MUST have exactly one operator"},
+		{"unknown operator", `{"like": ["cn", "a"]}`, "structuredFilter.like is not a known operator"},
+		{"empty and", `{"and": []}`, "structuredFilter.and MUST contain at least one filter"},
+		{"and which isn't an array", `{"and": {"eq": ["cn", "a"]}}`, "structuredFilter.and MUST be an array of filters"},
+		{"not which isn't a filter", `{"not": [{"eq": ["cn", "a"]}]}`, "structuredFilter.not MUST be a filter"},
+		{"null not", `{"not": null}`, "structuredFilter.not MUST be a filter"},
+		{"present which isn't a string", `{"present": ["mail"]}`, "structuredFilter.present MUST be an attribute name"},
+		{"comparison with one element", `{"eq": ["cn"]}`, "structuredFilter.eq MUST be an array of an attribute name and a value"},
+		{"comparison with three elements", `{"eq": ["cn", "a", "b"]}`, "structuredFilter.eq MUST be an array of an attribute name and a value"},
+		{"comparison with a number", `{"gte": ["uSNChanged", 1000]}`, "structuredFilter.gte MUST be an array of an attribute name and a value"},
+		{"empty substring", `{"startsWith": ["cn", ""]}`, "structuredFilter.startsWith MUST have a value"},
+		{"empty approx", `{"approx": ["cn", ""]}`, "structuredFilter.approx MUST have a value"},
+		{"attribute injection", `{"eq": ["cn=*)(uid", "a"]}`, `structuredFilter.eq: "cn=*)(uid" is not a valid attribute name`},
+		{"empty attribute", `{"present": ""}`, `structuredFilter.present: "" is not a valid attribute name`},
+		{"error in a nested filter", `{"and": [{"present": "mail"}, {"or": [{"eq": ["cn", "a"]}, {"contains": ["cn", ""]}]}]}`, "structuredFilter.and[1].or[1].contains MUST have a value"},
+		{"error inside not", `{"not": {"and": []}}`, "structuredFilter.not.and MUST contain at least one filter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildStructuredFilter(t, tt.json)
+			if err == nil {
+				t.Fatalf("expected %q, got filter %q", tt.err, got)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("expected %q, got %q", tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestQueryStructuredFilter(t *testing.T) {
+	var q Query
+
+	err := json.Unmarshal([]byte(`{"structuredFilter": {"eq": ["cn", "(admins)"]}, "base": "DC=corp,DC=local", "scope": "sub", "attributes": ["cn"]}`), &q)
+	if err != nil {
+		t.Fatalf("unable to unmarshal query: %v", err)
+	}
+
+	ve, err := q.Validate()
+	if err != nil || len(ve) > 0 {
+		t.Fatalf("expected query to be valid, got %v %v", ve, err)
+	}
+
+	if q.Filter != `(cn=\28admins\29)` {
+		t.Errorf("expected the filter to be built from the structured filter, got %q", q.Filter)
+	}
+
+	q = Query{}
+
+	err = json.Unmarshal([]byte(`{"filter": "(cn=user01)", "structuredFilter": {"present": "mail"}, "base": "DC=corp,DC=local", "scope": "sub", "attributes": ["cn"]}`), &q)
+	if err != nil {
+		t.Fatalf("unable to unmarshal query: %v", err)
+	}
+
+	ve, _ = q.Validate()
+
+	found := false
+	for _, v := range ve {
+		if v.Parameter == "structuredFilter" && v.Error == "filter and structuredFilter cannot both be used" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("expected filter and structuredFilter to be rejected together, got %v", ve)
+	}
+}
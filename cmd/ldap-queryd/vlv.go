@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/pkg/errors"
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// Virtual list view request and response controls; see draft-ietf-ldapext-ldapv3-vlv
+const (
+	controlTypeVLV         = "2.16.840.1.113730.3.4.9"
+	controlTypeVLVResponse = "2.16.840.1.113730.3.4.10"
+)
+
+// vlvRequest asks for a window onto the sorted results of a search, rather than all of them.
+// The target entry is either at Offset, counting from 1, or the first entry whose sort value is greater than or equal to GreaterThanOrEqual.
+// BeforeCount and AfterCount are the number of entries either side of the target to return with it.
+//
+// ContentCount is the consumer's estimate of the number of entries in the list, which the directory uses to scale Offset;
+// 0 means Offset is used as it is.
+// ContextID is the base64 encoded contextID returned with the previous window, if any.
+type vlvRequest struct {
+	BeforeCount        int    `json:"beforeCount"`
+	AfterCount         int    `json:"afterCount"`
+	Offset             int    `json:"offset"`
+	ContentCount       int    `json:"contentCount"`
+	GreaterThanOrEqual string `json:"greaterThanOrEqual"`
+	ContextID          string `json:"contextID"`
+}
+
+// vlvResult tells the consumer where the window is in the list, and how long the list is
+type vlvResult struct {
+	TargetPosition int    `json:"targetPosition"`
+	ContentCount   int    `json:"contentCount"`
+	ContextID      string `json:"contextID,omitempty"`
+}
+
+// controlVLV is the virtual list view request control, which the ldap package doesn't provide
+type controlVLV struct {
+	request   vlvRequest
+	contextID []byte
+}
+
+func newControlVLV(request vlvRequest) *controlVLV {
+	// The context ID has already been validated with the query
+	contextID, _ := base64.StdEncoding.DecodeString(request.ContextID)
+
+	return &controlVLV{
+		request:   request,
+		contextID: contextID,
+	}
+}
+
+// GetControlType returns the OID
+func (c *controlVLV) GetControlType() string {
+	return controlTypeVLV
+}
+
+// Encode returns the BER encoding of the control.
+// It is marked as critical, as a directory which ignored it would return every entry rather than the window asked for.
+//
+//	VirtualListViewRequest ::= SEQUENCE {
+//	    beforeCount    INTEGER (0..maxInt),
+//	    afterCount     INTEGER (0..maxInt),
+//	    target       CHOICE {
+//	        byOffset        [0] SEQUENCE {
+//	            offset          INTEGER (1 .. maxInt),
+//	            contentCount    INTEGER (0 .. maxInt) },
+//	        greaterThanOrEqual [1] AssertionValue },
+//	    contextID     OCTET STRING OPTIONAL }
+func (c *controlVLV) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlTypeVLV, "Control Type (Virtual List View)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Virtual List View)")
+	request := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewRequest")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.request.BeforeCount, "beforeCount"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.request.AfterCount, "afterCount"))
+
+	if c.request.Offset > 0 {
+		target := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "byOffset")
+		target.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.request.Offset, "offset"))
+		target.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.request.ContentCount, "contentCount"))
+		request.AppendChild(target)
+	} else {
+		request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, c.request.GreaterThanOrEqual, "greaterThanOrEqual"))
+	}
+
+	if len(c.contextID) > 0 {
+		request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(c.contextID), "contextID"))
+	}
+
+	value.AppendChild(request)
+	packet.AppendChild(value)
+
+	return packet
+}
+
+// String returns a human-readable description
+func (c *controlVLV) String() string {
+	return fmt.Sprintf(
+		"Control Type: Virtual List View (%q)  Criticality: true  BeforeCount: %d  AfterCount: %d  Offset: %d  ContentCount: %d  GreaterThanOrEqual: %q",
+		controlTypeVLV,
+		c.request.BeforeCount,
+		c.request.AfterCount,
+		c.request.Offset,
+		c.request.ContentCount,
+		c.request.GreaterThanOrEqual,
+	)
+}
+
+// readVLVResponse reads the virtual list view response control sent by the directory.
+// An error is returned if the directory didn't send the control, or was unable to provide the window asked for.
+//
+//	VirtualListViewResponse ::= SEQUENCE {
+//	    targetPosition    INTEGER (0 .. maxInt),
+//	    contentCount     INTEGER (0 .. maxInt),
+//	    virtualListViewResult ENUMERATED { ... },
+//	    contextID     OCTET STRING OPTIONAL }
+func readVLVResponse(controls []ldap.Control) (vlvResult, error) {
+	var result vlvResult
+
+	control, ok := ldap.FindControl(controls, controlTypeVLVResponse).(*ldap.ControlString)
+	if !ok {
+		return result, ldap.NewError(ldap.LDAPResultVirtualListViewErrorOrControlError, errors.New("directory did not return a virtual list view response"))
+	}
+
+	packet, err := ber.DecodePacketErr([]byte(control.ControlValue))
+	if err != nil || len(packet.Children) < 3 {
+		return result, ldap.NewError(ldap.LDAPResultVirtualListViewErrorOrControlError, errors.New("unable to decode virtual list view response"))
+	}
+
+	targetPosition, _ := packet.Children[0].Value.(int64)
+	contentCount, _ := packet.Children[1].Value.(int64)
+	code, _ := packet.Children[2].Value.(int64)
+
+	if code != ldap.LDAPResultSuccess {
+		return result, ldap.NewError(uint16(code), errors.New("directory was unable to return the virtual list view"))
+	}
+
+	result.TargetPosition = int(targetPosition)
+	result.ContentCount = int(contentCount)
+
+	if len(packet.Children) > 3 {
+		result.ContextID = base64.StdEncoding.EncodeToString(packet.Children[3].Data.Bytes())
+	}
+
+	return result, nil
+}
+
+// validate checks the virtual list view request; sort and paging are checked along with the rest of the query
+func (v *vlvRequest) validate() []ValidationError {
+	var ve []ValidationError
+
+	// The counts are checked separately, rather than added together, as a large enough pair would overflow and pass
+	if v.BeforeCount < 0 || v.AfterCount < 0 {
+		ve = append(ve, ValidationError{
+			Parameter: "vlv",
+			Error:     "beforeCount and afterCount cannot be negative",
+		})
+	} else if v.BeforeCount >= maxPageSize || v.AfterCount >= maxPageSize-v.BeforeCount {
+		ve = append(ve, ValidationError{
+			Parameter: "vlv",
+			Error:     fmt.Sprintf("no more than %d entries can be returned; reduce beforeCount or afterCount", maxPageSize),
+		})
+	}
+
+	if (v.Offset > 0) == (v.GreaterThanOrEqual != "") {
+		ve = append(ve, ValidationError{
+			Parameter: "vlv",
+			Error:     "exactly one of offset or greaterThanOrEqual MUST be specified",
+		})
+	}
+
+	if v.Offset < 0 || v.ContentCount < 0 {
+		ve = append(ve, ValidationError{
+			Parameter: "vlv",
+			Error:     "offset and contentCount cannot be negative",
+		})
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(v.ContextID); err != nil {
+		ve = append(ve, ValidationError{
+			Parameter: "vlv",
+			Error:     "contextID MUST be the base64 encoded contextID returned with the previous window",
+		})
+	}
+
+	return ve
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v3"
+)
+
+func TestControlVLVEncode(t *testing.T) {
+	longValue := strings.Repeat("a", 200)
+	contextID := []byte{0x00, 0x01, 0xfe, 0xff}
+
+	tests := []struct {
+		name      string
+		request   vlvRequest
+		target    uint8
+		want      []interface{}
+		contextID []byte
+	}{
+		{"by offset", vlvRequest{BeforeCount: 0, AfterCount: 49, Offset: 200}, 0, []interface{}{int64(200), int64(0)}, nil},
+		{"by offset with a content count", vlvRequest{BeforeCount: 5, AfterCount: 5, Offset: 50, ContentCount: 1000}, 0, []interface{}{int64(50), int64(1000)}, nil},
+		{"by offset with a large offset", vlvRequest{AfterCount: 1, Offset: 2147483647, ContentCount: 300}, 0, []interface{}{int64(2147483647), int64(300)}, nil},
+		{"by value", vlvRequest{AfterCount: 24, GreaterThanOrEqual: "M"}, 1, []interface{}{"M"}, nil},
+		{"by value longer than 127 bytes", vlvRequest{AfterCount: 24, GreaterThanOrEqual: longValue}, 1, []interface{}{longValue}, nil},
+		{"with a context ID", vlvRequest{AfterCount: 9, Offset: 1, ContextID: base64.StdEncoding.EncodeToString(contextID)}, 0, []interface{}{int64(1), int64(0)}, contextID},
+		{"by value with a context ID", vlvRequest{AfterCount: 9, GreaterThanOrEqual: "M", ContextID: base64.StdEncoding.EncodeToString(contextID)}, 1, []interface{}{"M"}, contextID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newControlVLV(tt.request)
+
+			packet, err := ber.DecodePacketErr(c.Encode().Bytes())
+			if err != nil {
+				t.Fatalf("unable to decode control: %v", err)
+			}
+
+			if len(packet.Children) != 3 {
+				t.Fatalf("expected the control type, criticality and value, got %d children", len(packet.Children))
+			}
+
+			if packet.Children[0].Value != controlTypeVLV {
+				t.Errorf("expected control type %q, got %v", controlTypeVLV, packet.Children[0].Value)
+			}
+
+			if packet.Children[1].Value != true {
+				t.Errorf("expected the control to be critical, got %v", packet.Children[1].Value)
+			}
+
+			value, err := ber.DecodePacketErr(packet.Children[2].Data.Bytes())
+			if err != nil {
+				t.Fatalf("unable to decode control value: %v", err)
+			}
+
+			wantChildren := 3
+			if tt.contextID != nil {
+				wantChildren = 4
+			}
+
+			if len(value.Children) != wantChildren {
+				t.Fatalf("expected %d children in the request, got %d", wantChildren, len(value.Children))
+			}
+
+			if value.Children[0].Value != int64(tt.request.BeforeCount) || value.Children[1].Value != int64(tt.request.AfterCount) {
+				t.Errorf("expected counts (%d, %d), got (%v, %v)", tt.request.BeforeCount, tt.request.AfterCount, value.Children[0].Value, value.Children[1].Value)
+			}
+
+			target := value.Children[2]
+			if target.ClassType != ber.ClassContext || uint8(target.Tag) != tt.target {
+				t.Fatalf("expected target [%d], got class %d tag %d", tt.target, target.ClassType, target.Tag)
+			}
+
+			var got []interface{}
+			if tt.target == 0 {
+				for _, c := range target.Children {
+					got = append(got, c.Value)
+				}
+			} else {
+				got = append(got, target.Data.String())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected target %v, got %v", tt.want, got)
+			}
+
+			if tt.contextID != nil && !bytes.Equal(value.Children[3].Data.Bytes(), tt.contextID) {
+				t.Errorf("expected context ID %x, got %x", tt.contextID, value.Children[3].Data.Bytes())
+			}
+		})
+	}
+}
+
+func TestControlVLVEncodeLongFormLength(t *testing.T) {
+	c := newControlVLV(vlvRequest{GreaterThanOrEqual: strings.Repeat("a", 200)})
+	b := c.Encode().Bytes()
+
+	// A length over 127 MUST use the long form, which here is one length octet of 200
+	if !bytes.Contains(b, []byte{0x81, 0x81, 0xc8}) {
+		t.Errorf("expected greaterThanOrEqual [1] to have a long form length of 200, got %x", b)
+	}
+}
+
+// vlvResponseControl builds the virtual list view response control the directory would send
+func vlvResponseControl(targetPosition, contentCount, result int64, contextID []byte) *ldap.ControlString {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewResponse")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, targetPosition, "targetPosition"))
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, contentCount, "contentCount"))
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, result, "virtualListViewResult"))
+
+	if contextID != nil {
+		value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(contextID), "contextID"))
+	}
+
+	return &ldap.ControlString{ControlType: controlTypeVLVResponse, ControlValue: string(value.Bytes())}
+}
+
+func TestReadVLVResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		controls []ldap.Control
+		want     vlvResult
+	}{
+		{"success", []ldap.Control{vlvResponseControl(200, 5000, 0, nil)}, vlvResult{TargetPosition: 200, ContentCount: 5000}},
+		{"with a context ID", []ldap.Control{vlvResponseControl(1, 10, 0, []byte{0x00, 0xff})}, vlvResult{TargetPosition: 1, ContentCount: 10, ContextID: "AP8="}},
+		{"large content count", []ldap.Control{vlvResponseControl(100000, 2147483647, 0, nil)}, vlvResult{TargetPosition: 100000, ContentCount: 2147483647}},
+		{"alongside other controls", []ldap.Control{sortResponseControl(0, ""), vlvResponseControl(3, 4, 0, nil)}, vlvResult{TargetPosition: 3, ContentCount: 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readVLVResponse(tt.controls)
+			if err != nil {
+				t.Fatalf("expected %+v, got %v", tt.want, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadVLVResponseErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		controls []ldap.Control
+		code     uint16
+	}{
+		{"no controls", nil, ldap.LDAPResultVirtualListViewErrorOrControlError},
+		{"no virtual list view control", []ldap.Control{sortResponseControl(0, "")}, ldap.LDAPResultVirtualListViewErrorOrControlError},
+		{"empty value", []ldap.Control{&ldap.ControlString{ControlType: controlTypeVLVResponse}}, ldap.LDAPResultVirtualListViewErrorOrControlError},
+		{"truncated value", []ldap.Control{&ldap.ControlString{ControlType: controlTypeVLVResponse, ControlValue: "\x30\x09\x02\x01\x01"}}, ldap.LDAPResultVirtualListViewErrorOrControlError},
+		{"too few children", []ldap.Control{&ldap.ControlString{ControlType: controlTypeVLVResponse, ControlValue: "\x30\x06\x02\x01\x01\x02\x01\x0a"}}, ldap.LDAPResultVirtualListViewErrorOrControlError},
+		{"offset out of range", []ldap.Control{vlvResponseControl(0, 0, 61, nil)}, 61},
+		{"sort control missing", []ldap.Control{vlvResponseControl(0, 0, 60, nil)}, 60},
+		{"unwilling to perform", []ldap.Control{vlvResponseControl(0, 0, 53, nil)}, ldap.LDAPResultUnwillingToPerform},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readVLVResponse(tt.controls)
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", got)
+			}
+
+			if !ldap.IsErrorWithCode(err, tt.code) {
+				t.Errorf("expected result code %d, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestVLVRequestValidate(t *testing.T) {
+	limit := "no more than 10000 entries can be returned; reduce beforeCount or afterCount"
+
+	tests := []struct {
+		name    string
+		request vlvRequest
+		want    []string
+	}{
+		{"by offset", vlvRequest{AfterCount: 49, Offset: 1}, nil},
+		{"by value", vlvRequest{BeforeCount: 10, AfterCount: 10, GreaterThanOrEqual: "M"}, nil},
+		{"with a context ID", vlvRequest{Offset: 1, ContextID: "AP8="}, nil},
+		{"largest window", vlvRequest{BeforeCount: 4999, AfterCount: 5000, Offset: 1}, nil},
+		{"window one too large", vlvRequest{BeforeCount: 5000, AfterCount: 5000, Offset: 1}, []string{limit}},
+		{"beforeCount too large", vlvRequest{BeforeCount: 10000, Offset: 1}, []string{limit}},
+		{"afterCount too large", vlvRequest{AfterCount: 10000, Offset: 1}, []string{limit}},
+		{"counts which would overflow", vlvRequest{BeforeCount: int(^uint(0) >> 2), AfterCount: int(^uint(0) >> 2), Offset: 1}, []string{limit}},
+		{"afterCount which would overflow", vlvRequest{BeforeCount: 1, AfterCount: int(^uint(0) >> 1), Offset: 1}, []string{limit}},
+		{"negative beforeCount", vlvRequest{BeforeCount: -1, AfterCount: 10, Offset: 1}, []string{"beforeCount and afterCount cannot be negative"}},
+		{"negative afterCount hiding a large beforeCount", vlvRequest{BeforeCount: 20000, AfterCount: -15000, Offset: 1}, []string{"beforeCount and afterCount cannot be negative"}},
+		{"no target", vlvRequest{AfterCount: 10}, []string{"exactly one of offset or greaterThanOrEqual MUST be specified"}},
+		{"both targets", vlvRequest{Offset: 1, GreaterThanOrEqual: "M"}, []string{"exactly one of offset or greaterThanOrEqual MUST be specified"}},
+		{"negative offset", vlvRequest{Offset: -1}, []string{"exactly one of offset or greaterThanOrEqual MUST be specified", "offset and contentCount cannot be negative"}},
+		{"negative contentCount", vlvRequest{Offset: 1, ContentCount: -1}, []string{"offset and contentCount cannot be negative"}},
+		{"invalid context ID", vlvRequest{Offset: 1, ContextID: "not base64!"}, []string{"contextID MUST be the base64 encoded contextID returned with the previous window"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range tt.request.validate() {
+				if v.Parameter != "vlv" {
+					t.Errorf("expected the vlv parameter, got %q", v.Parameter)
+				}
+
+				got = append(got, v.Error)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
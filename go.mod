@@ -3,8 +3,10 @@ module ldap-query
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/Freman/eventloghook v0.0.0-20191003051739-e4d803b6b48b
 	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/justinas/alice v1.2.0
 	github.com/kardianos/service v1.0.0
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
@@ -15,7 +17,9 @@ require (
 	github.com/rs/cors v1.8.0
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/sys v0.0.0-20200124204421-9fbb57f87de9
+	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d
 	gopkg.in/ldap.v3 v3.1.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -23,5 +27,4 @@ require (
 	github.com/golang/protobuf v1.3.2 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
-	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
 )